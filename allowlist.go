@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+
+	webserver "github.com/zhongjie-cai/web-server"
+)
+
+func getAllowedBackendIDs() []string {
+	var ids = []string{}
+	for id := range appConfig.AllowedBackends {
+		if !strings.Contains(id, "://") {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func getCanonicalHost(parsed *url.URL) string {
+	var port = parsed.Port()
+	if port == "" && parsed.Scheme == "http" {
+		port = "80"
+	}
+	if port == "" && parsed.Scheme == "https" {
+		port = "443"
+	}
+	return fmt.Sprint(strings.ToLower(parsed.Hostname()), ":", port)
+}
+
+func isPathWithin(path string, prefix string) bool {
+	prefix = strings.TrimSuffix(prefix, "/")
+	return prefix == "" ||
+		path == prefix ||
+		strings.HasPrefix(path, prefix+"/")
+}
+
+func isCleanURLPath(urlPath string) bool {
+	if urlPath == "" {
+		return true
+	}
+	var cleaned = path.Clean(urlPath)
+	return !strings.Contains(urlPath, "\\") &&
+		(cleaned == urlPath || cleaned+"/" == urlPath)
+}
+
+func isAllowedBackendURL(parsed *url.URL) bool {
+	var candidates = []string{}
+	for _, allowed := range appConfig.AllowedBackends {
+		candidates = append(candidates, allowed)
+	}
+	for allowed := range appConfig.Backends {
+		candidates = append(candidates, allowed)
+	}
+	for _, candidate := range candidates {
+		var allowed, allowedError = url.Parse(candidate)
+		if allowedError != nil {
+			continue
+		}
+		if allowed.Scheme == parsed.Scheme &&
+			getCanonicalHost(allowed) == getCanonicalHost(parsed) &&
+			isPathWithin(parsed.Path, allowed.Path) {
+			return true
+		}
+	}
+	return false
+}
+
+func getBackendNotAllowed(requested string, reason string) error {
+	return webserver.GetBadRequest(
+		fmt.Sprintf(
+			"reactor_api %q is not allowed: %s; use a configured backend id (%s) or a URL under an allowed backend",
+			requested,
+			reason,
+			strings.Join(getAllowedBackendIDs(), ", "),
+		),
+	)
+}
+
+func resolveBackendURL(requested string, defaultPath string) (string, error) {
+	if base, found := appConfig.AllowedBackends[requested]; found && !strings.Contains(requested, "://") {
+		var parsed, parseError = url.Parse(base)
+		if parseError != nil {
+			return "", getBackendNotAllowed(requested, parseError.Error())
+		}
+		if parsed.Path == "" || parsed.Path == "/" {
+			parsed.Path = defaultPath
+		}
+		return parsed.String(), nil
+	}
+	var parsed, parseError = url.Parse(requested)
+	if parseError != nil {
+		return "", getBackendNotAllowed(requested, "not a valid URL")
+	}
+	if parsed.Scheme != "http" && parsed.Scheme != "https" {
+		return "", getBackendNotAllowed(requested, "only http and https URLs are accepted")
+	}
+	if parsed.User != nil || parsed.Host == "" {
+		return "", getBackendNotAllowed(requested, "URL must name a host without credentials")
+	}
+	if !isCleanURLPath(parsed.Path) {
+		return "", getBackendNotAllowed(requested, "URL path must not contain empty, . or .. segments")
+	}
+	parsed.RawPath = ""
+	if !isAllowedBackendURL(parsed) {
+		return "", getBackendNotAllowed(requested, "URL is not under any allowed backend")
+	}
+	return parsed.String(), nil
+}
+
+func getFaceModelsAPI(requested string) (string, error) {
+	if requested == "" {
+		return appConfig.DefaultFaceModelsAPI, nil
+	}
+	return resolveBackendURL(requested, "/reactor/facemodels")
+}
@@ -2,9 +2,13 @@ package main
 
 import (
 	"archive/zip"
-	"bytes"
+	"bufio"
+	"encoding/binary"
 	"fmt"
-	"os"
+	"hash/crc32"
+	"io"
+	"strings"
+	"sync"
 	"time"
 )
 
@@ -25,42 +29,202 @@ func getZipName(namePrefix string, counter int) string {
 
 func writeErrorLog(
 	namePrefix string,
+	counter int,
 	errData error,
-	progress *progress,
-) {
-	var filename = fmt.Sprint(namePrefix, ".error.log")
-	progress.file = filename
-	os.WriteFile(
+) (string, error) {
+	var filename = fmt.Sprint(getZipName(namePrefix, counter), ".error.log")
+	var putError = outputs.Put(
 		filename,
 		[]byte(errData.Error()),
-		0,
 	)
+	if putError != nil {
+		return "", putError
+	}
+	return filename, nil
 }
 
-func writeArchive(
-	outImageBytes []imageBytes,
-	namePrefix string,
-	progress *progress,
-) error {
-	var buffer bytes.Buffer
-	var zipName = getZipName(namePrefix, progress.counter)
-	var zipper = zip.NewWriter(&buffer)
-	for _, imageBytes := range outImageBytes {
-		var writer, err = zipper.Create(imageBytes.name)
+type archiveWriter struct {
+	lock    sync.Mutex
+	name    string
+	output  storageWriter
+	zipper  *zip.Writer
+	entries int
+	err     error
+}
+
+func getArchiveName(namePrefix string, counter int) string {
+	return fmt.Sprint(getZipName(namePrefix, counter), ".cache.zip")
+}
+
+func newArchiveWriter(name string) (*archiveWriter, error) {
+	var output, outputErr = outputs.Create(name)
+	if outputErr != nil {
+		return nil, outputErr
+	}
+	return &archiveWriter{
+		name:   name,
+		output: output,
+		zipper: zip.NewWriter(output),
+	}, nil
+}
+
+func writeArchiveEntry(zipper *zip.Writer, name string, content []byte, modified time.Time) error {
+	var header = &zip.FileHeader{
+		Name:               name,
+		Method:             zip.Store,
+		CRC32:              crc32.ChecksumIEEE(content),
+		CompressedSize64:   uint64(len(content)),
+		UncompressedSize64: uint64(len(content)),
+	}
+	header.SetModTime(modified)
+	var writer, err = zipper.CreateRaw(header)
+	if err != nil {
+		return err
+	}
+	_, err = writer.Write(content)
+	if err != nil {
+		return err
+	}
+	return zipper.Flush()
+}
+
+func (archive *archiveWriter) add(entry imageBytes) error {
+	archive.lock.Lock()
+	defer archive.lock.Unlock()
+	if archive.err != nil {
+		return archive.err
+	}
+	archive.err = checkFreeSpace(int64(len(entry.bytes)))
+	if archive.err == nil {
+		archive.err = writeArchiveEntry(
+			archive.zipper,
+			entry.name,
+			entry.bytes,
+			time.Now(),
+		)
+	}
+	if archive.err == nil {
+		archive.err = archive.output.Sync()
+	}
+	if archive.err == nil {
+		archive.entries++
+	}
+	return archive.err
+}
+
+func (archive *archiveWriter) count() int {
+	archive.lock.Lock()
+	defer archive.lock.Unlock()
+	return archive.entries
+}
+
+func (archive *archiveWriter) close() (string, error) {
+	archive.lock.Lock()
+	defer archive.lock.Unlock()
+	if archive.err == nil {
+		archive.err = archive.zipper.Close()
+	}
+	if archive.err == nil {
+		archive.err = archive.output.Close()
+	}
+	if archive.err == nil {
+		return archive.name, nil
+	}
+	var keepError = archive.output.Keep()
+	if keepError != nil {
+		archive.output.Abort()
+		return "", archive.err
+	}
+	var salvagedName, _, _ = salvageArchive(archive.name)
+	return salvagedName, archive.err
+}
+
+func (archive *archiveWriter) abort() {
+	archive.lock.Lock()
+	defer archive.lock.Unlock()
+	archive.output.Abort()
+}
+
+func salvageArchive(name string) (string, int, error) {
+	var input, inputErr = outputs.Open(name + STORAGE_PARTIAL_SUFFIX)
+	if inputErr != nil {
+		return "", 0, inputErr
+	}
+	defer input.Close()
+	var salvagedName = fmt.Sprint(
+		strings.TrimSuffix(name, ".cache.zip"),
+		".recovered.cache.zip",
+	)
+	var output, outputErr = outputs.Create(salvagedName)
+	if outputErr != nil {
+		return "", 0, outputErr
+	}
+	var reader = bufio.NewReader(input)
+	var zipper = zip.NewWriter(output)
+	var recovered = 0
+	for {
+		var header [30]byte
+		var _, err = io.ReadFull(reader, header[:])
+		if err != nil || binary.LittleEndian.Uint32(header[0:]) != 0x04034b50 {
+			break
+		}
+		var flags = binary.LittleEndian.Uint16(header[6:])
+		var modifiedTime = binary.LittleEndian.Uint16(header[10:])
+		var modifiedDate = binary.LittleEndian.Uint16(header[12:])
+		var method = binary.LittleEndian.Uint16(header[8:])
+		var compressedSize = binary.LittleEndian.Uint32(header[18:])
+		if flags&0x8 != 0 || method != zip.Store || compressedSize == 0xFFFFFFFF {
+			break
+		}
+		var nameBytes = make([]byte, binary.LittleEndian.Uint16(header[26:]))
+		var extraLength = int64(binary.LittleEndian.Uint16(header[28:]))
+		var content = make([]byte, compressedSize)
+		_, err = io.ReadFull(reader, nameBytes)
+		if err == nil {
+			_, err = io.CopyN(io.Discard, reader, extraLength)
+		}
+		if err == nil {
+			_, err = io.ReadFull(reader, content)
+		}
+		if err != nil || crc32.ChecksumIEEE(content) != binary.LittleEndian.Uint32(header[14:]) {
+			break
+		}
+		var modified = time.Now()
+		if modifiedDate != 0 {
+			modified = time.Date(
+				1980+int(modifiedDate>>9),
+				time.Month(modifiedDate>>5&0xf),
+				int(modifiedDate&0x1f),
+				int(modifiedTime>>11),
+				int(modifiedTime>>5&0x3f),
+				int(modifiedTime&0x1f)*2,
+				0,
+				time.Local,
+			)
+		}
+		err = writeArchiveEntry(
+			zipper,
+			string(nameBytes),
+			content,
+			modified,
+		)
 		if err != nil {
-			return err
+			output.Abort()
+			return "", 0, err
 		}
-		writer.Write(imageBytes.bytes)
+		recovered++
 	}
 	var err = zipper.Close()
+	if err == nil {
+		err = output.Close()
+	}
 	if err != nil {
-		return err
+		output.Abort()
+		return "", 0, err
 	}
-	var filename = fmt.Sprint(zipName, ".cache.zip")
-	progress.file = filename
-	return os.WriteFile(
-		filename,
-		buffer.Bytes(),
-		0,
-	)
+	if recovered == 0 {
+		outputs.Delete(salvagedName)
+		salvagedName = ""
+	}
+	return salvagedName, recovered, outputs.Delete(name + STORAGE_PARTIAL_SUFFIX)
 }
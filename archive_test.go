@@ -0,0 +1,154 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"errors"
+	"image"
+	"image/color"
+	"image/png"
+	"testing"
+)
+
+func getTestPNG(t *testing.T) []byte {
+	var canvas = image.NewRGBA(image.Rect(0, 0, 8, 8))
+	canvas.Set(1, 1, color.RGBA{R: 255, A: 255})
+	var buffer bytes.Buffer
+	var err = png.Encode(&buffer, canvas)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buffer.Bytes()
+}
+
+func readArchiveNames(t *testing.T, name string) []string {
+	var content, err = outputs.Get(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var reader, readerErr = zip.NewReader(bytes.NewReader(content), int64(len(content)))
+	if readerErr != nil {
+		t.Fatal(readerErr)
+	}
+	var names = []string{}
+	for _, file := range reader.File {
+		names = append(names, file.Name)
+	}
+	return names
+}
+
+func exhaustFreeSpace(t *testing.T) {
+	var free, known = getFreeSpace()
+	if !known {
+		t.Skip("free space is not reported on this platform")
+	}
+	appConfig.MinFreeBytes = int(free) + 1
+}
+
+func TestSalvageArchive(t *testing.T) {
+	useTestStorage(t)
+	var archive, err = newArchiveWriter("salvage.cache.zip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	archive.add(imageBytes{name: "a.jpg", bytes: []byte("first")})
+	archive.add(imageBytes{name: "b.jpg", bytes: []byte("second")})
+	archive.output.Write([]byte("PK\x03\x04truncated"))
+	archive.output.Keep()
+	var salvagedName, recovered, salvageErr = salvageArchive("salvage.cache.zip")
+	if salvageErr != nil || recovered != 2 || salvagedName != "salvage.recovered.cache.zip" {
+		t.Fatalf("unexpected salvage result %q %d %v", salvagedName, recovered, salvageErr)
+	}
+	var names = readArchiveNames(t, salvagedName)
+	if len(names) != 2 || names[0] != "a.jpg" || names[1] != "b.jpg" {
+		t.Fatalf("unexpected salvaged entries %v", names)
+	}
+	if _, err := outputs.Stat("salvage.cache.zip" + STORAGE_PARTIAL_SUFFIX); err == nil {
+		t.Fatal("partial archive should be removed after salvaging")
+	}
+}
+
+func TestArchiveKeepsEntriesWrittenBeforeFailure(t *testing.T) {
+	useTestStorage(t)
+	var archive, err = newArchiveWriter("failed.cache.zip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := archive.add(imageBytes{name: "a.jpg", bytes: []byte("first")}); err != nil {
+		t.Fatal(err)
+	}
+	exhaustFreeSpace(t)
+	if err := archive.add(imageBytes{name: "b.jpg", bytes: []byte("second")}); !errors.Is(err, errQuotaExceeded) {
+		t.Fatalf("expected the free space guard to trip, got %v", err)
+	}
+	appConfig.MinFreeBytes = 0
+	var filename, closeErr = archive.close()
+	if !errors.Is(closeErr, errQuotaExceeded) {
+		t.Fatalf("expected close to report the add failure, got %v", closeErr)
+	}
+	var names = readArchiveNames(t, filename)
+	if len(names) != 1 || names[0] != "a.jpg" {
+		t.Fatalf("unexpected entries %v", names)
+	}
+}
+
+func TestProcessImageStopsOnArchiveFailure(t *testing.T) {
+	useTestStorage(t)
+	var targets = []imageBytes{}
+	for _, name := range []string{"a.png", "b.png", "c.png", "d.png"} {
+		targets = append(targets, imageBytes{name: name, bytes: getTestPNG(t)})
+	}
+	var archive, err = newArchiveWriter("stopped.cache.zip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	exhaustFreeSpace(t)
+	var control = newJobControl(context.Background())
+	var processed, _, processErr = processImage(
+		control.ctx,
+		mockProcessor{},
+		targets,
+		getAllIndexes(len(targets)),
+		"stopped",
+		"archive-failure",
+		90,
+		reactorOptions{},
+		0,
+		control,
+		archive,
+	)
+	if !errors.Is(processErr, errQuotaExceeded) {
+		t.Fatalf("expected the archive failure to be returned, got %v", processErr)
+	}
+	if len(processed) == len(targets) {
+		t.Fatal("remaining images should be canceled after the first archive failure")
+	}
+	archive.abort()
+}
+
+type failingPutStorage struct {
+	storage
+}
+
+func (failingPutStorage) Put(name string, content []byte) error {
+	return errors.New("put failed")
+}
+
+func TestWriteErrorLogNamesAreUniquePerJob(t *testing.T) {
+	useTestStorage(t)
+	var first, firstErr = writeErrorLog("IMG", 1, errors.New("first"))
+	var second, secondErr = writeErrorLog("IMG", 2, errors.New("second"))
+	if firstErr != nil || secondErr != nil || first == second {
+		t.Fatalf("expected distinct error logs, got %q %q %v %v", first, second, firstErr, secondErr)
+	}
+	var content, _ = outputs.Get(first)
+	if string(content) != "first" {
+		t.Fatalf("first error log was overwritten: %q", content)
+	}
+	outputs = failingPutStorage{outputs}
+	var failed, failedErr = writeErrorLog("IMG", 3, errors.New("third"))
+	if failedErr == nil || failed != "" {
+		t.Fatalf("a failed write must not return a file name, got %q %v", failed, failedErr)
+	}
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+
+	webserver "github.com/zhongjie-cai/web-server"
+)
+
+const BACKEND_POOL string = "pool"
+
+type backend struct {
+	URL                 string        `json:"url"`
+	Weight              int           `json:"weight"`
+	Healthy             bool          `json:"healthy"`
+	InFlight            int           `json:"in_flight"`
+	Requests            int           `json:"requests"`
+	Failures            int           `json:"failures"`
+	ConsecutiveFailures int           `json:"consecutive_failures"`
+	TotalLatency        time.Duration `json:"-"`
+	AverageLatency      string        `json:"average_latency,omitempty"`
+	LastError           string        `json:"last_error,omitempty"`
+	LastCheckedAt       *time.Time    `json:"last_checked_at,omitempty"`
+}
+
+type backendPool struct {
+	lock     sync.Mutex
+	backends []*backend
+	released chan struct{}
+}
+
+var backends = newBackendPool(map[string]int{})
+
+var errNoBackend = errors.New("no reactor backend available")
+
+func newBackendPool(weights map[string]int) *backendPool {
+	var pool = &backendPool{
+		released: make(chan struct{}),
+	}
+	for address, weight := range weights {
+		pool.backends = append(pool.backends, &backend{
+			URL:     address,
+			Weight:  weight,
+			Healthy: true,
+		})
+	}
+	sort.Slice(
+		pool.backends,
+		func(i, j int) bool {
+			return pool.backends[i].URL < pool.backends[j].URL
+		},
+	)
+	return pool
+}
+
+func (pool *backendPool) size() int {
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+	return len(pool.backends)
+}
+
+func (pool *backendPool) capacity() int {
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+	var total = 0
+	for _, entry := range pool.backends {
+		total += getBackendLimit(entry.URL)
+	}
+	return total
+}
+
+func getBackendLimit(address string) int {
+	var limit, configured = appConfig.EndpointLimits[address]
+	if !configured {
+		return appConfig.EndpointConcurrency
+	}
+	return limit
+}
+
+func getBackendLoad(entry *backend) float64 {
+	return float64(entry.InFlight+1) / float64(entry.Weight)
+}
+
+func (pool *backendPool) hasUntried(tried map[string]bool) bool {
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+	for _, entry := range pool.backends {
+		if entry.Healthy && !tried[entry.URL] {
+			return true
+		}
+	}
+	return false
+}
+
+func (pool *backendPool) acquire(ctx context.Context, tried map[string]bool) (*backend, error) {
+	for {
+		pool.lock.Lock()
+		var picked, candidates = pool.pick(tried)
+		if picked != nil {
+			picked.InFlight++
+			picked.Requests++
+		}
+		var released = pool.released
+		pool.lock.Unlock()
+		if picked != nil {
+			return picked, nil
+		}
+		if candidates == 0 {
+			return nil, errNoBackend
+		}
+		select {
+		case <-released:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func (pool *backendPool) pick(tried map[string]bool) (*backend, int) {
+	var picked *backend
+	var candidates = 0
+	for _, healthyOnly := range []bool{true, false} {
+		for _, entry := range pool.backends {
+			if tried[entry.URL] || (healthyOnly && !entry.Healthy) {
+				continue
+			}
+			candidates++
+			if entry.InFlight >= getBackendLimit(entry.URL) {
+				continue
+			}
+			if picked == nil ||
+				getBackendLoad(entry) < getBackendLoad(picked) ||
+				(getBackendLoad(entry) == getBackendLoad(picked) && entry.Requests*picked.Weight < picked.Requests*entry.Weight) {
+				picked = entry
+			}
+		}
+		if candidates > 0 {
+			break
+		}
+	}
+	return picked, candidates
+}
+
+func isBackendFailure(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) {
+		return false
+	}
+	var statusCode = getRetryStatusCode(err)
+	return statusCode == 0 || statusCode >= http.StatusInternalServerError
+}
+
+func (pool *backendPool) recordResult(entry *backend, err error) {
+	if isBackendFailure(err) {
+		entry.Failures++
+		entry.ConsecutiveFailures++
+		entry.LastError = err.Error()
+		if entry.ConsecutiveFailures >= appConfig.BackendFailures {
+			entry.Healthy = false
+		}
+		return
+	}
+	entry.ConsecutiveFailures = 0
+	entry.Healthy = true
+}
+
+func (pool *backendPool) release(entry *backend, err error, latency time.Duration) {
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+	entry.InFlight--
+	entry.TotalLatency += latency
+	pool.recordResult(entry, err)
+	close(pool.released)
+	pool.released = make(chan struct{})
+}
+
+func (pool *backendPool) stats() []backend {
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+	var all = make([]backend, 0, len(pool.backends))
+	for _, entry := range pool.backends {
+		var copied = *entry
+		if copied.Requests > 0 {
+			copied.AverageLatency = (copied.TotalLatency / time.Duration(copied.Requests)).Round(time.Millisecond).String()
+		}
+		all = append(all, copied)
+	}
+	return all
+}
+
+func resolveBackend(ctx context.Context, reactorAPI string, tried map[string]bool) (string, func(error), error) {
+	if reactorAPI != BACKEND_POOL {
+		return reactorAPI, func(error) {}, nil
+	}
+	var entry, entryError = backends.acquire(ctx, tried)
+	if entryError != nil {
+		return "", nil, entryError
+	}
+	var startedAt = time.Now()
+	return entry.URL, func(err error) {
+		backends.release(entry, err, time.Since(startedAt))
+	}, nil
+}
+
+func getHealthURL(address string) (string, error) {
+	var parsed, parseError = url.Parse(address)
+	if parseError != nil {
+		return "", parseError
+	}
+	parsed.Path = appConfig.BackendHealthPath
+	parsed.RawQuery = ""
+	return parsed.String(), nil
+}
+
+func probeBackend(ctx context.Context, address string) error {
+	var healthURL, healthURLError = getHealthURL(address)
+	if healthURLError != nil {
+		return healthURLError
+	}
+	var probeCtx, cancelProbe = context.WithTimeout(ctx, appConfig.BackendHealthWait)
+	defer cancelProbe()
+	var request, requestError = http.NewRequestWithContext(
+		probeCtx,
+		http.MethodGet,
+		healthURL,
+		nil,
+	)
+	if requestError != nil {
+		return requestError
+	}
+	var response, responseError = http.DefaultClient.Do(request)
+	if responseError != nil {
+		return responseError
+	}
+	response.Body.Close()
+	if response.StatusCode >= http.StatusInternalServerError {
+		return &reactorStatusError{
+			StatusCode: response.StatusCode,
+			Status:     response.Status,
+		}
+	}
+	return nil
+}
+
+func (pool *backendPool) probe(ctx context.Context) {
+	var waitGroup sync.WaitGroup
+	for _, entry := range pool.stats() {
+		waitGroup.Add(1)
+		go func(address string) {
+			defer waitGroup.Done()
+			var probeError = probeBackend(ctx, address)
+			if ctx.Err() != nil {
+				return
+			}
+			pool.lock.Lock()
+			defer pool.lock.Unlock()
+			for _, candidate := range pool.backends {
+				if candidate.URL != address {
+					continue
+				}
+				var checkedAt = time.Now()
+				candidate.LastCheckedAt = &checkedAt
+				if probeError != nil {
+					candidate.LastError = fmt.Sprint("health probe: ", probeError.Error())
+					candidate.ConsecutiveFailures = appConfig.BackendFailures
+					candidate.Healthy = false
+				} else {
+					candidate.ConsecutiveFailures = 0
+					candidate.Healthy = true
+				}
+			}
+		}(entry.URL)
+	}
+	waitGroup.Wait()
+}
+
+func doProbingBackends() {
+	if backends.size() == 0 || appConfig.BackendHealthEvery <= 0 {
+		return
+	}
+	var ticker = time.NewTicker(appConfig.BackendHealthEvery)
+	defer ticker.Stop()
+	for {
+		backends.probe(appContext)
+		select {
+		case <-appContext.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+type backendList struct {
+	Backends []backend `json:"backends"`
+}
+
+func listBackendsAction(session webserver.Session) (interface{}, error) {
+	return backendList{
+		Backends: backends.stats(),
+	}, nil
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestBackendPoolRespectsPerBackendLimits(t *testing.T) {
+	var saved = appConfig
+	defer func() { appConfig = saved }()
+	appConfig.EndpointLimits = map[string]int{
+		"http://a": 1,
+		"http://b": 10,
+	}
+	var pool = newBackendPool(map[string]int{
+		"http://a": 10,
+		"http://b": 1,
+	})
+	var counts = map[string]int{}
+	for i := 0; i < 6; i++ {
+		var entry, err = pool.acquire(context.Background(), map[string]bool{})
+		if err != nil {
+			t.Fatalf("acquire %d: %v", i, err)
+		}
+		counts[entry.URL]++
+	}
+	if counts["http://a"] != 1 || counts["http://b"] != 5 {
+		t.Fatalf("expected 1 request on a and 5 on b, got %v", counts)
+	}
+}
+
+func TestBackendPoolWaitsForFreeCapacity(t *testing.T) {
+	var saved = appConfig
+	defer func() { appConfig = saved }()
+	appConfig.EndpointLimits = map[string]int{
+		"http://a": 1,
+	}
+	var pool = newBackendPool(map[string]int{
+		"http://a": 1,
+	})
+	var first, err = pool.acquire(context.Background(), map[string]bool{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = pool.acquire(ctx, map[string]bool{})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the full backend to block, got %v", err)
+	}
+	var acquired = make(chan *backend)
+	go func() {
+		var entry, _ = pool.acquire(context.Background(), map[string]bool{})
+		acquired <- entry
+	}()
+	pool.release(first, nil, time.Millisecond)
+	select {
+	case entry := <-acquired:
+		if entry == nil || entry.URL != "http://a" {
+			t.Fatalf("unexpected backend %v", entry)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("waiting acquire was not woken by release")
+	}
+}
+
+func TestBackendPoolReportsNoBackend(t *testing.T) {
+	var pool = newBackendPool(map[string]int{
+		"http://a": 1,
+	})
+	var _, err = pool.acquire(context.Background(), map[string]bool{"http://a": true})
+	if !errors.Is(err, errNoBackend) {
+		t.Fatalf("expected errNoBackend, got %v", err)
+	}
+}
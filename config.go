@@ -0,0 +1,681 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	webserver "github.com/zhongjie-cai/web-server"
+	"gopkg.in/yaml.v3"
+)
+
+type config struct {
+	ConfigFile           string
+	ListenAddress        string
+	TLSCert              string
+	TLSKey               string
+	OutputDir            string
+	Storage              string
+	S3Endpoint           string
+	S3Region             string
+	S3Bucket             string
+	S3Prefix             string
+	S3AccessKey          string
+	S3SecretKey          string
+	S3PathStyle          bool
+	MultipartMemory      int
+	DefaultReactorAPI    string
+	DefaultFaceModelsAPI string
+	ReactorFacesDir      string
+	Workers              int
+	EndpointConcurrency  int
+	EndpointLimits       map[string]int
+	QueueDepth           int
+	RetryAfterSeconds    int
+	MaxPriority          int
+	RetryCount           int
+	RetryBaseDelay       time.Duration
+	RetryMaxDelay        time.Duration
+	RetryStatuses        map[int]int
+	ImageTimeout         time.Duration
+	BatchTimeout         time.Duration
+	ShutdownWait         time.Duration
+	InputsDir            string
+	ResultsDir           string
+	LibraryDir           string
+	InputRetention       time.Duration
+	RetentionAge         time.Duration
+	RetentionMaxBytes    int
+	RetentionMaxCount    int
+	JanitorInterval      time.Duration
+	QuotaPerUser         int
+	QuotaGlobal          int
+	MinFreeBytes         int
+	PresetsFile          string
+	Backends             map[string]int
+	AllowedBackends      map[string]string
+	BackendHealthPath    string
+	BackendHealthEvery   time.Duration
+	BackendHealthWait    time.Duration
+	BackendFailures      int
+}
+
+var appConfig = config{
+	ListenAddress:        ":8080",
+	TLSCert:              "/data/v2ray.crt",
+	TLSKey:               "/data/v2ray.key",
+	OutputDir:            "outputs",
+	Storage:              "local",
+	S3Region:             "us-east-1",
+	S3PathStyle:          true,
+	MultipartMemory:      2097152,
+	DefaultReactorAPI:    "http://localhost:7860/reactor/image",
+	DefaultFaceModelsAPI: DEFAULT_FACE_MODELS_API,
+	Workers:              2,
+	EndpointConcurrency:  1,
+	EndpointLimits:       map[string]int{},
+	QueueDepth:           64,
+	RetryAfterSeconds:    30,
+	MaxPriority:          9,
+	RetryCount:           3,
+	RetryBaseDelay:       time.Second,
+	RetryMaxDelay:        30 * time.Second,
+	RetryStatuses: map[int]int{
+		0:                             3,
+		http.StatusBadGateway:         3,
+		http.StatusServiceUnavailable: 3,
+		http.StatusGatewayTimeout:     3,
+	},
+	ImageTimeout:    5 * time.Minute,
+	BatchTimeout:    0,
+	ShutdownWait:    30 * time.Second,
+	InputsDir:       "inputs",
+	ResultsDir:      "results",
+	LibraryDir:      "library",
+	InputRetention:  24 * time.Hour,
+	JanitorInterval: 10 * time.Minute,
+	MinFreeBytes:    100 * 1024 * 1024,
+	Backends:        map[string]int{},
+	AllowedBackends: map[string]string{
+		"local": "http://localhost:7860",
+	},
+	BackendHealthPath:  "/reactor/facemodels",
+	BackendHealthEvery: 30 * time.Second,
+	BackendHealthWait:  5 * time.Second,
+	BackendFailures:    3,
+}
+
+type stringSetting struct {
+	target *string
+}
+
+func (setting stringSetting) String() string {
+	if setting.target == nil {
+		return ""
+	}
+	return *setting.target
+}
+
+func (setting stringSetting) Set(value string) error {
+	*setting.target = strings.TrimSpace(value)
+	return nil
+}
+
+type intSetting struct {
+	target *int
+}
+
+func (setting intSetting) String() string {
+	if setting.target == nil {
+		return ""
+	}
+	return strconv.Itoa(*setting.target)
+}
+
+func (setting intSetting) Set(value string) error {
+	var parsed, err = strconv.Atoi(strings.TrimSpace(value))
+	if err != nil {
+		return fmt.Errorf("%q is not an integer", value)
+	}
+	*setting.target = parsed
+	return nil
+}
+
+type boolSetting struct {
+	target *bool
+}
+
+func (setting boolSetting) String() string {
+	if setting.target == nil {
+		return ""
+	}
+	return strconv.FormatBool(*setting.target)
+}
+
+func (setting boolSetting) Set(value string) error {
+	var parsed, err = strconv.ParseBool(strings.TrimSpace(value))
+	if err != nil {
+		return fmt.Errorf("%q is not true or false", value)
+	}
+	*setting.target = parsed
+	return nil
+}
+
+type durationSetting struct {
+	target *time.Duration
+}
+
+func (setting durationSetting) String() string {
+	if setting.target == nil {
+		return ""
+	}
+	return setting.target.String()
+}
+
+func (setting durationSetting) Set(value string) error {
+	var parsed, err = time.ParseDuration(strings.TrimSpace(value))
+	if err != nil {
+		return fmt.Errorf("%q is not a duration such as 30s or 5m", value)
+	}
+	*setting.target = parsed
+	return nil
+}
+
+func getMapEntries(value string) []string {
+	var entries = []string{}
+	for _, entry := range strings.Split(value, ",") {
+		if strings.TrimSpace(entry) != "" {
+			entries = append(entries, strings.TrimSpace(entry))
+		}
+	}
+	return entries
+}
+
+func cutLastEquals(entry string) (string, string, bool) {
+	var separator = strings.LastIndex(entry, "=")
+	if separator <= 0 {
+		return entry, "", false
+	}
+	return strings.TrimSpace(entry[:separator]), strings.TrimSpace(entry[separator+1:]), true
+}
+
+func joinSorted(entries []string) string {
+	sort.Strings(entries)
+	return strings.Join(entries, ",")
+}
+
+type limitsSetting struct {
+	target *map[string]int
+}
+
+func (setting limitsSetting) String() string {
+	if setting.target == nil {
+		return ""
+	}
+	var entries = []string{}
+	for key, limit := range *setting.target {
+		entries = append(entries, fmt.Sprint(key, "=", limit))
+	}
+	return joinSorted(entries)
+}
+
+func (setting limitsSetting) Set(value string) error {
+	var limits = map[string]int{}
+	for _, entry := range getMapEntries(value) {
+		var key, limit, found = cutLastEquals(entry)
+		var parsed, err = strconv.Atoi(limit)
+		if !found || err != nil {
+			return fmt.Errorf("%q is not in the form key=number", entry)
+		}
+		limits[key] = parsed
+	}
+	*setting.target = limits
+	return nil
+}
+
+type statusesSetting struct {
+	target *map[int]int
+}
+
+func (setting statusesSetting) String() string {
+	if setting.target == nil {
+		return ""
+	}
+	var entries = []string{}
+	for statusCode, count := range *setting.target {
+		entries = append(entries, fmt.Sprint(statusCode, "=", count))
+	}
+	return joinSorted(entries)
+}
+
+func (setting statusesSetting) Set(value string) error {
+	var limits = map[string]int{}
+	var limitsError = limitsSetting{&limits}.Set(value)
+	if limitsError != nil {
+		return limitsError
+	}
+	var statuses = map[int]int{}
+	for statusCode, count := range limits {
+		var code, err = strconv.Atoi(statusCode)
+		if err != nil {
+			return fmt.Errorf("%q is not a status code, use 0 for connection errors", statusCode)
+		}
+		statuses[code] = count
+	}
+	*setting.target = statuses
+	return nil
+}
+
+type weightsSetting struct {
+	target *map[string]int
+}
+
+func (setting weightsSetting) String() string {
+	return limitsSetting(setting).String()
+}
+
+func (setting weightsSetting) Set(value string) error {
+	var weights = map[string]int{}
+	for _, entry := range getMapEntries(value) {
+		var address, weight = entry, 1
+		if key, limit, found := cutLastEquals(entry); found {
+			var parsed, err = strconv.Atoi(limit)
+			if err != nil {
+				return fmt.Errorf("%q is not in the form url or url=weight", entry)
+			}
+			address, weight = key, parsed
+		}
+		weights[address] = weight
+	}
+	*setting.target = weights
+	return nil
+}
+
+type backendsSetting struct {
+	target *map[string]string
+}
+
+func (setting backendsSetting) String() string {
+	if setting.target == nil {
+		return ""
+	}
+	var entries = []string{}
+	for id, address := range *setting.target {
+		if id == address {
+			entries = append(entries, address)
+		} else {
+			entries = append(entries, fmt.Sprint(id, "=", address))
+		}
+	}
+	return joinSorted(entries)
+}
+
+func (setting backendsSetting) Set(value string) error {
+	var allowed = map[string]string{}
+	for _, entry := range getMapEntries(value) {
+		var id, address, named = strings.Cut(entry, "=")
+		if !named || strings.Contains(id, "://") {
+			id, address = entry, entry
+		}
+		allowed[strings.TrimSpace(id)] = strings.TrimSpace(address)
+	}
+	*setting.target = allowed
+	return nil
+}
+
+type configSetting struct {
+	name   string
+	env    string
+	secret bool
+	value  flag.Value
+	source string
+	flag   *string
+}
+
+var configSettings = []*configSetting{
+	{name: "listen_address", env: "IMAGE_PROCESSOR_LISTEN_ADDRESS", value: stringSetting{&appConfig.ListenAddress}},
+	{name: "tls_cert", env: "IMAGE_PROCESSOR_TLS_CERT", value: stringSetting{&appConfig.TLSCert}},
+	{name: "tls_key", env: "IMAGE_PROCESSOR_TLS_KEY", value: stringSetting{&appConfig.TLSKey}},
+	{name: "output_dir", env: "IMAGE_PROCESSOR_OUTPUT_DIR", value: stringSetting{&appConfig.OutputDir}},
+	{name: "storage", env: "IMAGE_PROCESSOR_STORAGE", value: stringSetting{&appConfig.Storage}},
+	{name: "s3_endpoint", env: "IMAGE_PROCESSOR_S3_ENDPOINT", value: stringSetting{&appConfig.S3Endpoint}},
+	{name: "s3_region", env: "IMAGE_PROCESSOR_S3_REGION", value: stringSetting{&appConfig.S3Region}},
+	{name: "s3_bucket", env: "IMAGE_PROCESSOR_S3_BUCKET", value: stringSetting{&appConfig.S3Bucket}},
+	{name: "s3_prefix", env: "IMAGE_PROCESSOR_S3_PREFIX", value: stringSetting{&appConfig.S3Prefix}},
+	{name: "s3_access_key", env: "IMAGE_PROCESSOR_S3_ACCESS_KEY", value: stringSetting{&appConfig.S3AccessKey}, secret: true},
+	{name: "s3_secret_key", env: "IMAGE_PROCESSOR_S3_SECRET_KEY", value: stringSetting{&appConfig.S3SecretKey}, secret: true},
+	{name: "s3_path_style", env: "IMAGE_PROCESSOR_S3_PATH_STYLE", value: boolSetting{&appConfig.S3PathStyle}},
+	{name: "multipart_memory", env: "IMAGE_PROCESSOR_MULTIPART_MEMORY", value: intSetting{&appConfig.MultipartMemory}},
+	{name: "default_reactor_api", env: "IMAGE_PROCESSOR_DEFAULT_REACTOR_API", value: stringSetting{&appConfig.DefaultReactorAPI}},
+	{name: "default_face_models_api", env: "IMAGE_PROCESSOR_DEFAULT_FACE_MODELS_API", value: stringSetting{&appConfig.DefaultFaceModelsAPI}},
+	{name: "reactor_faces_dir", env: "IMAGE_PROCESSOR_REACTOR_FACES_DIR", value: stringSetting{&appConfig.ReactorFacesDir}},
+	{name: "workers", env: "IMAGE_PROCESSOR_WORKERS", value: intSetting{&appConfig.Workers}},
+	{name: "endpoint_concurrency", env: "IMAGE_PROCESSOR_ENDPOINT_CONCURRENCY", value: intSetting{&appConfig.EndpointConcurrency}},
+	{name: "endpoint_limits", env: "IMAGE_PROCESSOR_ENDPOINT_LIMITS", value: limitsSetting{&appConfig.EndpointLimits}},
+	{name: "queue_depth", env: "IMAGE_PROCESSOR_QUEUE_DEPTH", value: intSetting{&appConfig.QueueDepth}},
+	{name: "retry_after", env: "IMAGE_PROCESSOR_RETRY_AFTER", value: intSetting{&appConfig.RetryAfterSeconds}},
+	{name: "max_priority", env: "IMAGE_PROCESSOR_MAX_PRIORITY", value: intSetting{&appConfig.MaxPriority}},
+	{name: "retry_count", env: "IMAGE_PROCESSOR_RETRY_COUNT", value: intSetting{&appConfig.RetryCount}},
+	{name: "retry_delay", env: "IMAGE_PROCESSOR_RETRY_DELAY", value: durationSetting{&appConfig.RetryBaseDelay}},
+	{name: "retry_max_delay", env: "IMAGE_PROCESSOR_RETRY_MAX_DELAY", value: durationSetting{&appConfig.RetryMaxDelay}},
+	{name: "retry_statuses", env: "IMAGE_PROCESSOR_RETRY_STATUSES", value: statusesSetting{&appConfig.RetryStatuses}},
+	{name: "image_timeout", env: "IMAGE_PROCESSOR_IMAGE_TIMEOUT", value: durationSetting{&appConfig.ImageTimeout}},
+	{name: "batch_timeout", env: "IMAGE_PROCESSOR_BATCH_TIMEOUT", value: durationSetting{&appConfig.BatchTimeout}},
+	{name: "shutdown_wait", env: "IMAGE_PROCESSOR_SHUTDOWN_WAIT", value: durationSetting{&appConfig.ShutdownWait}},
+	{name: "inputs_dir", env: "IMAGE_PROCESSOR_INPUTS_DIR", value: stringSetting{&appConfig.InputsDir}},
+	{name: "results_dir", env: "IMAGE_PROCESSOR_RESULTS_DIR", value: stringSetting{&appConfig.ResultsDir}},
+	{name: "library_dir", env: "IMAGE_PROCESSOR_LIBRARY_DIR", value: stringSetting{&appConfig.LibraryDir}},
+	{name: "input_retention", env: "IMAGE_PROCESSOR_INPUT_RETENTION", value: durationSetting{&appConfig.InputRetention}},
+	{name: "retention_age", env: "IMAGE_PROCESSOR_RETENTION_AGE", value: durationSetting{&appConfig.RetentionAge}},
+	{name: "retention_max_bytes", env: "IMAGE_PROCESSOR_RETENTION_MAX_BYTES", value: intSetting{&appConfig.RetentionMaxBytes}},
+	{name: "retention_max_count", env: "IMAGE_PROCESSOR_RETENTION_MAX_COUNT", value: intSetting{&appConfig.RetentionMaxCount}},
+	{name: "janitor_interval", env: "IMAGE_PROCESSOR_JANITOR_INTERVAL", value: durationSetting{&appConfig.JanitorInterval}},
+	{name: "quota_per_user", env: "IMAGE_PROCESSOR_QUOTA_PER_USER", value: intSetting{&appConfig.QuotaPerUser}},
+	{name: "quota_global", env: "IMAGE_PROCESSOR_QUOTA_GLOBAL", value: intSetting{&appConfig.QuotaGlobal}},
+	{name: "min_free_bytes", env: "IMAGE_PROCESSOR_MIN_FREE_BYTES", value: intSetting{&appConfig.MinFreeBytes}},
+	{name: "presets_file", env: "IMAGE_PROCESSOR_PRESETS_FILE", value: stringSetting{&appConfig.PresetsFile}},
+	{name: "backends", env: "IMAGE_PROCESSOR_BACKENDS", value: weightsSetting{&appConfig.Backends}},
+	{name: "allowed_backends", env: "IMAGE_PROCESSOR_ALLOWED_BACKENDS", value: backendsSetting{&appConfig.AllowedBackends}},
+	{name: "backend_health_path", env: "IMAGE_PROCESSOR_BACKEND_HEALTH_PATH", value: stringSetting{&appConfig.BackendHealthPath}},
+	{name: "backend_health_interval", env: "IMAGE_PROCESSOR_BACKEND_HEALTH_INTERVAL", value: durationSetting{&appConfig.BackendHealthEvery}},
+	{name: "backend_health_timeout", env: "IMAGE_PROCESSOR_BACKEND_HEALTH_TIMEOUT", value: durationSetting{&appConfig.BackendHealthWait}},
+	{name: "backend_failures", env: "IMAGE_PROCESSOR_BACKEND_FAILURES", value: intSetting{&appConfig.BackendFailures}},
+}
+
+func getConfigSetting(name string) (*configSetting, bool) {
+	for _, setting := range configSettings {
+		if setting.name == name {
+			return setting, true
+		}
+	}
+	return nil, false
+}
+
+func getFlagName(name string) string {
+	return strings.ReplaceAll(name, "_", "-")
+}
+
+func getNodeString(node *yaml.Node) (string, error) {
+	switch node.Kind {
+	case yaml.ScalarNode:
+		return node.Value, nil
+	case yaml.SequenceNode:
+		var entries = []string{}
+		for _, child := range node.Content {
+			if child.Kind != yaml.ScalarNode {
+				return "", errors.New("lists may only contain plain values")
+			}
+			entries = append(entries, child.Value)
+		}
+		return strings.Join(entries, ","), nil
+	case yaml.MappingNode:
+		var entries = []string{}
+		for index := 0; index+1 < len(node.Content); index += 2 {
+			var key, value = node.Content[index], node.Content[index+1]
+			if key.Kind != yaml.ScalarNode || value.Kind != yaml.ScalarNode {
+				return "", errors.New("maps may only contain plain values")
+			}
+			entries = append(entries, fmt.Sprint(key.Value, "=", value.Value))
+		}
+		return strings.Join(entries, ","), nil
+	}
+	return "", errors.New("unsupported value")
+}
+
+func loadConfigFile(path string) error {
+	var fileBytes, fileBytesError = os.ReadFile(path)
+	if fileBytesError != nil {
+		return fileBytesError
+	}
+	var document map[string]yaml.Node
+	var documentError = yaml.Unmarshal(fileBytes, &document)
+	if documentError != nil {
+		return fmt.Errorf("invalid config file %s: %w", path, documentError)
+	}
+	var problems = []error{}
+	for name, node := range document {
+		var setting, found = getConfigSetting(name)
+		if !found {
+			problems = append(problems, fmt.Errorf("unknown setting %s", name))
+			continue
+		}
+		var value, valueError = getNodeString(&node)
+		if valueError == nil {
+			valueError = setting.value.Set(value)
+		}
+		if valueError != nil {
+			problems = append(problems, fmt.Errorf("%s: %w", name, valueError))
+			continue
+		}
+		setting.source = "file"
+	}
+	return errors.Join(problems...)
+}
+
+func loadConfig(args []string) error {
+	for _, setting := range configSettings {
+		setting.source = "default"
+		setting.flag = nil
+	}
+	var flags = flag.NewFlagSet("image-processor", flag.ContinueOnError)
+	var configFile = flags.String(
+		"config",
+		os.Getenv("IMAGE_PROCESSOR_CONFIG"),
+		"YAML or JSON configuration file, also IMAGE_PROCESSOR_CONFIG",
+	)
+	for _, setting := range configSettings {
+		var usage = fmt.Sprintf("overrides %s and the %s setting", setting.env, setting.name)
+		if setting.value.String() != "" {
+			usage = fmt.Sprintf("%s (default %s)", usage, setting.value.String())
+		}
+		flags.Func(
+			getFlagName(setting.name),
+			usage,
+			func(value string) error {
+				setting.flag = &value
+				return setting.value.Set(value)
+			},
+		)
+	}
+	var parseError = flags.Parse(args)
+	if parseError != nil {
+		return parseError
+	}
+	if flags.NArg() > 0 {
+		return fmt.Errorf("unexpected argument %q", flags.Arg(0))
+	}
+	appConfig.ConfigFile = *configFile
+	var problems = []error{}
+	if appConfig.ConfigFile != "" {
+		var fileError = loadConfigFile(appConfig.ConfigFile)
+		if fileError != nil {
+			problems = append(problems, fileError)
+		}
+	}
+	for _, setting := range configSettings {
+		var value, found = os.LookupEnv(setting.env)
+		if !found || strings.TrimSpace(value) == "" {
+			continue
+		}
+		var setError = setting.value.Set(value)
+		if setError != nil {
+			problems = append(problems, fmt.Errorf("%s: %w", setting.env, setError))
+			continue
+		}
+		setting.source = "env"
+	}
+	for _, setting := range configSettings {
+		if setting.flag == nil {
+			continue
+		}
+		setting.value.Set(*setting.flag)
+		setting.source = "flag"
+	}
+	return errors.Join(problems...)
+}
+
+func isHTTPURL(value string) bool {
+	var parsed, err = url.Parse(value)
+	return err == nil &&
+		(parsed.Scheme == "http" || parsed.Scheme == "https") &&
+		parsed.Host != ""
+}
+
+func (settings config) validate() error {
+	var problems = []string{}
+	if settings.ListenAddress == "" {
+		problems = append(problems, "listen_address must not be empty")
+	}
+	if (settings.TLSCert == "") != (settings.TLSKey == "") {
+		problems = append(problems, "tls_cert and tls_key must be set together")
+	}
+	if settings.OutputDir == "" {
+		problems = append(problems, "output_dir must not be empty")
+	}
+	if settings.Storage != "local" && settings.Storage != "s3" {
+		problems = append(problems, "storage must be local or s3")
+	}
+	if settings.Storage == "s3" && (!isHTTPURL(settings.S3Endpoint) || settings.S3Bucket == "" || settings.S3Region == "") {
+		problems = append(problems, "s3 storage needs an http or https s3_endpoint, s3_bucket and s3_region")
+	}
+	if settings.Storage == "s3" && (settings.S3AccessKey == "" || settings.S3SecretKey == "") {
+		problems = append(problems, "s3 storage needs s3_access_key and s3_secret_key")
+	}
+	if validateStorageName(settings.InputsDir) != nil {
+		problems = append(problems, "inputs_dir must be a relative path inside the output storage")
+	}
+	if validateStorageName(settings.ResultsDir) != nil {
+		problems = append(problems, "results_dir must be a relative path inside the output storage")
+	}
+	if validateStorageName(settings.LibraryDir) != nil {
+		problems = append(problems, "library_dir must be a relative path inside the output storage")
+	}
+	if settings.ResultsDir == settings.InputsDir ||
+		settings.LibraryDir == settings.InputsDir ||
+		settings.LibraryDir == settings.ResultsDir {
+		problems = append(problems, "results_dir, inputs_dir and library_dir must differ")
+	}
+	if settings.MultipartMemory < 1 {
+		problems = append(problems, "multipart_memory must be positive")
+	}
+	if !isHTTPURL(settings.DefaultReactorAPI) {
+		problems = append(problems, "default_reactor_api must be an http or https URL")
+	}
+	if !isHTTPURL(settings.DefaultFaceModelsAPI) {
+		problems = append(problems, "default_face_models_api must be an http or https URL")
+	}
+	if settings.ReactorFacesDir != "" {
+		if info, statError := os.Stat(settings.ReactorFacesDir); statError != nil || !info.IsDir() {
+			problems = append(problems, "reactor_faces_dir must be an existing directory")
+		}
+	}
+	if settings.Workers < 1 || settings.EndpointConcurrency < 1 || settings.QueueDepth < 1 || settings.BackendFailures < 1 {
+		problems = append(problems, "workers, endpoint_concurrency, queue_depth and backend_failures must be at least 1")
+	}
+	if settings.RetryAfterSeconds < 0 || settings.MaxPriority < 0 || settings.RetryCount < 0 {
+		problems = append(problems, "retry_after, max_priority and retry_count must not be negative")
+	}
+	if settings.RetentionMaxBytes < 0 || settings.RetentionMaxCount < 0 {
+		problems = append(problems, "retention_max_bytes and retention_max_count must not be negative, use 0 to disable")
+	}
+	if settings.QuotaPerUser < 0 || settings.QuotaGlobal < 0 || settings.MinFreeBytes < 0 {
+		problems = append(problems, "quota_per_user, quota_global and min_free_bytes must not be negative, use 0 to disable")
+	}
+	if settings.QuotaPerUser > 0 && settings.QuotaGlobal == 0 {
+		problems = append(problems, "quota_per_user is advisory because submitters are not authenticated, set quota_global as well")
+	}
+	if settings.JanitorInterval <= 0 {
+		problems = append(problems, "janitor_interval must be positive")
+	}
+	for _, duration := range []time.Duration{
+		settings.RetryBaseDelay,
+		settings.RetryMaxDelay,
+		settings.ImageTimeout,
+		settings.BatchTimeout,
+		settings.ShutdownWait,
+		settings.InputRetention,
+		settings.RetentionAge,
+		settings.BackendHealthEvery,
+		settings.BackendHealthWait,
+	} {
+		if duration < 0 {
+			problems = append(problems, "durations must not be negative")
+			break
+		}
+	}
+	for key, limit := range settings.EndpointLimits {
+		if limit < 1 {
+			problems = append(problems, fmt.Sprintf("endpoint_limits for %s must be at least 1", key))
+		}
+	}
+	for statusCode, count := range settings.RetryStatuses {
+		if count < 0 || (statusCode != 0 && (statusCode < 100 || statusCode > 599)) {
+			problems = append(problems, fmt.Sprintf("retry_statuses entry %d=%d is invalid", statusCode, count))
+		}
+	}
+	for address, weight := range settings.Backends {
+		if !isHTTPURL(address) || weight < 1 {
+			problems = append(problems, fmt.Sprintf("backends entry %s=%d must be an http or https URL with a positive weight", address, weight))
+		}
+	}
+	for id, address := range settings.AllowedBackends {
+		if !isHTTPURL(address) {
+			problems = append(problems, fmt.Sprintf("allowed_backends entry %s must be an http or https URL", id))
+		}
+	}
+	if !strings.HasPrefix(settings.BackendHealthPath, "/") {
+		problems = append(problems, "backend_health_path must start with /")
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid configuration: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+var credentialsPattern = regexp.MustCompile(`://[^/@\s,]+@`)
+
+func getRedactedValue(setting *configSetting) string {
+	var value = setting.value.String()
+	if setting.secret && value != "" {
+		return "********"
+	}
+	return credentialsPattern.ReplaceAllString(value, "://********@")
+}
+
+type configEntry struct {
+	Name   string `json:"name"`
+	Value  string `json:"value"`
+	Source string `json:"source"`
+	Env    string `json:"env"`
+	Flag   string `json:"flag"`
+}
+
+type configView struct {
+	File     string        `json:"file,omitempty"`
+	Settings []configEntry `json:"settings"`
+}
+
+func getConfigAction(session webserver.Session) (interface{}, error) {
+	var view = configView{
+		File:     appConfig.ConfigFile,
+		Settings: []configEntry{},
+	}
+	for _, setting := range configSettings {
+		view.Settings = append(view.Settings, configEntry{
+			Name:   setting.name,
+			Value:  getRedactedValue(setting),
+			Source: setting.source,
+			Env:    setting.env,
+			Flag:   fmt.Sprint("-", getFlagName(setting.name)),
+		})
+	}
+	return view, nil
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+var errJobPaused = errors.New("job is paused")
+
+type jobControl struct {
+	ctx       context.Context
+	cancel    context.CancelFunc
+	lock      sync.Mutex
+	paused    bool
+	suspended *item
+}
+
+func newJobControl(parent context.Context) *jobControl {
+	var ctx, cancel = context.WithCancel(parent)
+	return &jobControl{
+		ctx:    ctx,
+		cancel: cancel,
+	}
+}
+
+func (control *jobControl) pause() {
+	control.lock.Lock()
+	defer control.lock.Unlock()
+	control.paused = true
+}
+
+func (control *jobControl) resume() *item {
+	control.lock.Lock()
+	defer control.lock.Unlock()
+	control.paused = false
+	var suspended = control.suspended
+	control.suspended = nil
+	return suspended
+}
+
+func (control *jobControl) isPaused() bool {
+	control.lock.Lock()
+	defer control.lock.Unlock()
+	return control.paused
+}
+
+func (control *jobControl) suspend(suspended item) bool {
+	control.lock.Lock()
+	defer control.lock.Unlock()
+	if !control.paused || control.ctx.Err() != nil {
+		return false
+	}
+	control.suspended = &suspended
+	return true
+}
+
+func (control *jobControl) takeSuspended() *item {
+	control.lock.Lock()
+	defer control.lock.Unlock()
+	var suspended = control.suspended
+	control.suspended = nil
+	return suspended
+}
+
+type jobControls struct {
+	lock    sync.Mutex
+	entries map[int]*jobControl
+}
+
+var controls = &jobControls{
+	entries: map[int]*jobControl{},
+}
+
+var appContext, appCancel = context.WithCancel(context.Background())
+
+var activeBatches sync.WaitGroup
+
+func shutdownProcessing(waitTime time.Duration) {
+	appCancel()
+	var drained = make(chan struct{})
+	go func() {
+		activeBatches.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+	case <-time.After(waitTime):
+	}
+}
+
+func (controls *jobControls) register(counter int) *jobControl {
+	var control = newJobControl(appContext)
+	controls.lock.Lock()
+	controls.entries[counter] = control
+	controls.lock.Unlock()
+	return control
+}
+
+func (controls *jobControls) get(counter int) (*jobControl, bool) {
+	controls.lock.Lock()
+	defer controls.lock.Unlock()
+	var control, found = controls.entries[counter]
+	return control, found
+}
+
+func (controls *jobControls) remove(counter int) {
+	controls.lock.Lock()
+	var control, found = controls.entries[counter]
+	delete(controls.entries, counter)
+	controls.lock.Unlock()
+	if found {
+		control.cancel()
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestJobControlSuspendAndResume(t *testing.T) {
+	var control = newJobControl(context.Background())
+	if control.suspend(item{counter: 1}) {
+		t.Fatal("a running job must not be suspended")
+	}
+	control.pause()
+	if !control.suspend(item{counter: 1}) {
+		t.Fatal("a paused job should be suspended")
+	}
+	var resumed = control.resume()
+	if resumed == nil || resumed.counter != 1 || control.isPaused() {
+		t.Fatalf("resume should hand back the suspended item, got %+v", resumed)
+	}
+	if control.resume() != nil {
+		t.Fatal("the suspended item must be handed back only once")
+	}
+	control.pause()
+	control.cancel()
+	if control.suspend(item{counter: 1}) {
+		t.Fatal("a canceled job must not be suspended")
+	}
+}
+
+func TestAcquireUnpausedRefusesPausedJobs(t *testing.T) {
+	var control = newJobControl(context.Background())
+	control.pause()
+	if _, err := acquireUnpaused(control.ctx, control, "paused-endpoint"); !errors.Is(err, errJobPaused) {
+		t.Fatalf("expected errJobPaused, got %v", err)
+	}
+	control.resume()
+	var slot, err = acquireUnpaused(control.ctx, control, "paused-endpoint")
+	if err != nil {
+		t.Fatal(err)
+	}
+	slot.release()
+}
+
+func TestJobControlsRemoveCancels(t *testing.T) {
+	var control = controls.register(9999)
+	if found, _ := controls.get(9999); found != control {
+		t.Fatal("registered control should be found")
+	}
+	controls.remove(9999)
+	if _, found := controls.get(9999); found || control.ctx.Err() == nil {
+		t.Fatal("removing a control should forget and cancel it")
+	}
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"crypto/tls"
 	"net/http"
+	"path/filepath"
 
 	webserver "github.com/zhongjie-cai/web-server"
 )
@@ -12,18 +13,63 @@ type myCustomization struct {
 }
 
 func (customization *myCustomization) ServerCert() *tls.Certificate {
-    var cert, err = tls.LoadX509KeyPair("/data/v2ray.crt", "/data/v2ray.key")
+    if appConfig.TLSCert == "" {
+        return nil
+    }
+    var cert, err = tls.LoadX509KeyPair(appConfig.TLSCert, appConfig.TLSKey)
     if err != nil {
         return nil
     }
     return &cert
 }
 
+func (customization *myCustomization) PreBootstrap() error {
+    var configErr = appConfig.validate()
+    if configErr != nil {
+        return configErr
+    }
+    var store, storeErr = newStorage()
+    if storeErr != nil {
+        return storeErr
+    }
+    outputs = newMeteredStorage(store)
+    var legacyErr = migrateLegacyOutputs(LEGACY_OUTPUT_DIR)
+    if legacyErr != nil {
+        return legacyErr
+    }
+    var libraryErr = migrateLegacyFaceModelLibrary()
+    if libraryErr != nil {
+        return libraryErr
+    }
+    queue = newJobQueue(appConfig.QueueDepth)
+    backends = newBackendPool(appConfig.Backends)
+    var presetsErr = loadPresetsFile(appConfig.PresetsFile)
+    if presetsErr != nil {
+        return presetsErr
+    }
+    var jobStore, jobStoreErr = newFileJobStore(
+        filepath.Join(appConfig.OutputDir, JOB_STORE_FILE),
+    )
+    if jobStoreErr != nil {
+        return jobStoreErr
+    }
+    jobs = jobStore
+    restoreJobs()
+    return nil
+}
+
 func (customization *myCustomization) PostBootstrap() error {
-    go doProcessing()
+    startWorkers(appConfig.Workers)
+    go doCleaning()
+    go doProbingBackends()
 	return nil
 }
 
+func (customization *myCustomization) AppClosing() error {
+    shutdownProcessing(appConfig.ShutdownWait)
+    return jobs.Sync()
+}
+
 func (customization *myCustomization) Routes() []webserver.Route {
     return []webserver.Route{
         {
@@ -38,12 +84,191 @@ func (customization *myCustomization) Routes() []webserver.Route {
             Path:       "/process",
             ActionFunc: processAction,
         },
+        {
+            Endpoint:   "ProcessWith",
+            Method:     http.MethodPost,
+            Path:       "/process/{processor}",
+            ActionFunc: processAction,
+            Parameters: map[string]webserver.ParameterType{
+                "processor": webserver.ParameterTypeString,
+            },
+        },
+        {
+            Endpoint:   "ListProcessors",
+            Method:     http.MethodGet,
+            Path:       "/processors",
+            ActionFunc: listProcessorsAction,
+        },
+        {
+            Endpoint:   "ListBackends",
+            Method:     http.MethodGet,
+            Path:       "/backends",
+            ActionFunc: listBackendsAction,
+        },
+        {
+            Endpoint:   "GetConfig",
+            Method:     http.MethodGet,
+            Path:       "/config",
+            ActionFunc: getConfigAction,
+        },
+        {
+            Endpoint:   "GetRetention",
+            Method:     http.MethodGet,
+            Path:       "/retention",
+            ActionFunc: getRetentionAction,
+        },
+        {
+            Endpoint:   "GetQuota",
+            Method:     http.MethodGet,
+            Path:       "/quota",
+            ActionFunc: getQuotaAction,
+        },
+        {
+            Endpoint:   "Presets",
+            Method:     http.MethodGet,
+            Path:       "/presets",
+            ActionFunc: listPresetsAction,
+        },
+        {
+            Endpoint:   "Models",
+            Method:     http.MethodGet,
+            Path:       "/models",
+            ActionFunc: listModelsAction,
+        },
         {
             Endpoint:   "Model",
             Method:     http.MethodPost,
             Path:       "/model",
             ActionFunc: modelAction,
         },
+        {
+            Endpoint:   "ListJobs",
+            Method:     http.MethodGet,
+            Path:       "/jobs",
+            ActionFunc: listJobsAction,
+        },
+        {
+            Endpoint:   "GetJob",
+            Method:     http.MethodGet,
+            Path:       "/jobs/{counter}",
+            ActionFunc: getJobAction,
+            Parameters: map[string]webserver.ParameterType{
+                "counter": webserver.ParameterTypeInteger,
+            },
+        },
+        {
+            Endpoint:   "CancelJob",
+            Method:     http.MethodDelete,
+            Path:       "/jobs/{counter}",
+            ActionFunc: cancelJobAction,
+            Parameters: map[string]webserver.ParameterType{
+                "counter": webserver.ParameterTypeInteger,
+            },
+        },
+        {
+            Endpoint:   "PauseJob",
+            Method:     http.MethodPost,
+            Path:       "/jobs/{counter}/pause",
+            ActionFunc: pauseJobAction,
+            Parameters: map[string]webserver.ParameterType{
+                "counter": webserver.ParameterTypeInteger,
+            },
+        },
+        {
+            Endpoint:   "ResumeJob",
+            Method:     http.MethodPost,
+            Path:       "/jobs/{counter}/resume",
+            ActionFunc: resumeJobAction,
+            Parameters: map[string]webserver.ParameterType{
+                "counter": webserver.ParameterTypeInteger,
+            },
+        },
+        {
+            Endpoint:   "RetryJob",
+            Method:     http.MethodPost,
+            Path:       "/jobs/{counter}/retry",
+            ActionFunc: retryJobAction,
+            Parameters: map[string]webserver.ParameterType{
+                "counter": webserver.ParameterTypeInteger,
+            },
+        },
+        {
+            Endpoint:   "GetJobImage",
+            Method:     http.MethodGet,
+            Path:       "/jobs/{counter}/images/{index}",
+            ActionFunc: getJobImageAction,
+            Parameters: map[string]webserver.ParameterType{
+                "counter": webserver.ParameterTypeInteger,
+                "index":   webserver.ParameterTypeInteger,
+            },
+        },
+        {
+            Endpoint:   "GetJobThumbnail",
+            Method:     http.MethodGet,
+            Path:       "/jobs/{counter}/images/{index}/thumbnail",
+            ActionFunc: getJobThumbnailAction,
+            Parameters: map[string]webserver.ParameterType{
+                "counter": webserver.ParameterTypeInteger,
+                "index":   webserver.ParameterTypeInteger,
+            },
+        },
+        {
+            Endpoint:   "ListLibrary",
+            Method:     http.MethodGet,
+            Path:       "/library",
+            ActionFunc: listLibraryAction,
+        },
+        {
+            Endpoint:   "UploadLibrary",
+            Method:     http.MethodPost,
+            Path:       "/library",
+            ActionFunc: uploadLibraryAction,
+        },
+        {
+            Endpoint:   "GetLibrary",
+            Method:     http.MethodGet,
+            Path:       "/library/{name}",
+            ActionFunc: getLibraryAction,
+            Parameters: map[string]webserver.ParameterType{
+                "name": FACE_MODEL_NAME_PARAMETER,
+            },
+        },
+        {
+            Endpoint:   "DeleteLibrary",
+            Method:     http.MethodDelete,
+            Path:       "/library/{name}",
+            ActionFunc: deleteLibraryAction,
+            Parameters: map[string]webserver.ParameterType{
+                "name": FACE_MODEL_NAME_PARAMETER,
+            },
+        },
+        {
+            Endpoint:   "DownloadLibrary",
+            Method:     http.MethodGet,
+            Path:       "/library/{name}/download",
+            ActionFunc: downloadLibraryAction,
+            Parameters: map[string]webserver.ParameterType{
+                "name": FACE_MODEL_NAME_PARAMETER,
+            },
+        },
+        {
+            Endpoint:   "RenameLibrary",
+            Method:     http.MethodPost,
+            Path:       "/library/{name}/rename",
+            ActionFunc: renameLibraryAction,
+            Parameters: map[string]webserver.ParameterType{
+                "name": FACE_MODEL_NAME_PARAMETER,
+            },
+        },
+        {
+            Endpoint:   "PushLibrary",
+            Method:     http.MethodPost,
+            Path:       "/library/{name}/push",
+            ActionFunc: pushLibraryAction,
+            Parameters: map[string]webserver.ParameterType{
+                "name": FACE_MODEL_NAME_PARAMETER,
+            },
+        },
         {
             Endpoint:   "Download",
             Method:     http.MethodGet,
@@ -0,0 +1,7 @@
+//go:build !unix
+
+package main
+
+func (store *localStorage) FreeSpace() (int64, error) {
+	return -1, nil
+}
@@ -0,0 +1,16 @@
+//go:build unix
+
+package main
+
+import (
+	"syscall"
+)
+
+func (store *localStorage) FreeSpace() (int64, error) {
+	var stat syscall.Statfs_t
+	var statError = syscall.Statfs(store.root, &stat)
+	if statError != nil {
+		return 0, statError
+	}
+	return int64(stat.Bavail) * int64(stat.Bsize), nil
+}
@@ -3,91 +3,135 @@ package main
 import (
 	"fmt"
 	"net/http"
-	"os"
 	"strconv"
 
 	webserver "github.com/zhongjie-cai/web-server"
 )
 
-func downloadAction(session webserver.Session) (interface{}, error) {
-	var counter int
-	var counterError = session.GetRequestParameter(
-		"counter",
-		&counter,
-	)
-	if counterError != nil {
-		return nil, counterError
+type countingResponseWriter struct {
+	http.ResponseWriter
+	status  int
+	written int64
+}
+
+func (writer *countingResponseWriter) WriteHeader(status int) {
+	writer.status = status
+	writer.ResponseWriter.WriteHeader(status)
+}
+
+func (writer *countingResponseWriter) Write(content []byte) (int, error) {
+	if writer.status == 0 {
+		writer.status = http.StatusOK
 	}
-	statusListLock.RLock()
-	var progress, found = statusList[counter]
-	statusListLock.RUnlock()
-	if !found {
-		return nil, fmt.Errorf("target not found for counter %d", counter)
+	var written, writeError = writer.ResponseWriter.Write(content)
+	writer.written += int64(written)
+	return written, writeError
+}
+
+func (writer *countingResponseWriter) reachedEnd(size int64) bool {
+	switch writer.status {
+	case http.StatusOK:
+		return writer.written == size
+	case http.StatusPartialContent:
+		var contentRange = writer.Header().Get("Content-Range")
+		var first, last, total int64
+		var _, scanError = fmt.Sscanf(
+			contentRange,
+			"bytes %d-%d/%d",
+			&first,
+			&last,
+			&total,
+		)
+		return scanError == nil &&
+			last == size-1 &&
+			writer.written == last-first+1
 	}
-	var filename = progress.file
-	var fileBytes, fileBytesError = os.ReadFile(filename)
-	if fileBytesError != nil {
-		return nil, fileBytesError
+	return false
+}
+
+func setAttachmentHeaders(responseWriter http.ResponseWriter, attachment string) {
+	if attachment == "" {
+		return
 	}
-	var responseWriter = session.GetResponseWriter()
 	responseWriter.Header().Set(
 		"Content-Type",
 		"application/octet-stream",
 	)
-	responseWriter.Header().Set(
-		"Content-Length",
-		strconv.Itoa(len(fileBytes)),
-	)
 	responseWriter.Header().Set(
 		"Content-Disposition",
-		fmt.Sprint("attachment;filename=", filename),
+		fmt.Sprint("attachment;filename=", strconv.Quote(attachment)),
 	)
-	responseWriter.WriteHeader(http.StatusOK)
-	responseWriter.Write(fileBytes)
-	return webserver.SkipResponseHandling()
 }
 
-func downloadAndDeleteAction(session webserver.Session) (interface{}, error) {
+func serveOutput(session webserver.Session, filename string, attachment string) (*countingResponseWriter, int64, error) {
+	var object, objectError = outputs.Stat(filename)
+	if objectError != nil {
+		return nil, 0, objectError
+	}
+	var content, contentError = outputs.Open(filename)
+	if contentError != nil {
+		return nil, 0, contentError
+	}
+	defer content.Close()
+	var responseWriter = &countingResponseWriter{
+		ResponseWriter: session.GetResponseWriter(),
+	}
+	setAttachmentHeaders(responseWriter, attachment)
+	http.ServeContent(
+		responseWriter,
+		session.GetRequest(),
+		filename,
+		object.ModTime,
+		content,
+	)
+	return responseWriter, object.Size, nil
+}
+
+func getDownloadFile(session webserver.Session) (int, string, error) {
 	var counter int
 	var counterError = session.GetRequestParameter(
 		"counter",
 		&counter,
 	)
 	if counterError != nil {
-		return nil, counterError
+		return 0, "", counterError
 	}
-	statusListLock.RLock()
-	var progress, found = statusList[counter]
-	statusListLock.RUnlock()
-	if !found {
-		return nil, fmt.Errorf("target not found for counter %d", counter)
+	var job, found = jobs.Get(counter)
+	if !found || job.File == "" {
+		return 0, "", fmt.Errorf("target not found for counter %d", counter)
 	}
-	var filename = progress.file
-	var fileBytes, fileBytesError = os.ReadFile(filename)
-	if fileBytesError != nil {
-		return nil, fileBytesError
+	return counter, job.File, nil
+}
+
+func downloadAction(session webserver.Session) (interface{}, error) {
+	var _, filename, filenameError = getDownloadFile(session)
+	if filenameError != nil {
+		return nil, filenameError
 	}
-	var deleteError = os.Remove(filename)
-	if deleteError != nil {
-		return nil, deleteError
+	var _, _, serveError = serveOutput(session, filename, filename)
+	if serveError != nil {
+		return nil, serveError
+	}
+	return webserver.SkipResponseHandling()
+}
+
+func downloadAndDeleteAction(session webserver.Session) (interface{}, error) {
+	var counter, filename, filenameError = getDownloadFile(session)
+	if filenameError != nil {
+		return nil, filenameError
+	}
+	var responseWriter, size, serveError = serveOutput(session, filename, filename)
+	if serveError != nil {
+		return nil, serveError
+	}
+	if session.GetRequest().Method == http.MethodHead ||
+		!responseWriter.reachedEnd(size) {
+		return webserver.SkipResponseHandling()
+	}
+	var deleteError = outputs.Delete(filename)
+	if deleteError == nil {
+		deleteJobResults(counter)
+		jobs.Delete(counter)
 	}
-	statusListLock.Lock()
-	delete(statusList, counter)
-	statusListLock.Unlock()
-	var responseWriter = session.GetResponseWriter()
-	responseWriter.Header().Set(
-		"Content-Type",
-		"application/octet-stream",
-	)
-	responseWriter.Header().Set(
-		"Content-Length",
-		strconv.Itoa(len(fileBytes)),
-	)
-	responseWriter.Header().Set(
-		"Content-Disposition",
-		fmt.Sprint("attachment;filename=", filename),
-	)
-	responseWriter.WriteHeader(http.StatusOK)
-	responseWriter.Write(fileBytes)
 	return webserver.SkipResponseHandling()
 }
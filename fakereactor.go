@@ -0,0 +1,261 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type fakeReactor struct {
+	latency       time.Duration
+	failureRate   float64
+	failureStatus int
+	lock          sync.Mutex
+	requests      int
+	faceModels    map[string]bool
+	facesDir      string
+}
+
+func newFakeReactor(latency time.Duration, failureRate float64, failureStatus int) *fakeReactor {
+	return &fakeReactor{
+		latency:       latency,
+		failureRate:   failureRate,
+		failureStatus: failureStatus,
+		faceModels:    map[string]bool{},
+	}
+}
+
+func (reactor *fakeReactor) handler() http.Handler {
+	var mux = http.NewServeMux()
+	mux.HandleFunc("/reactor/image", reactor.imageHandler)
+	mux.HandleFunc("/reactor/facemodels", reactor.faceModelsHandler)
+	return mux
+}
+
+func (reactor *fakeReactor) shouldFail() bool {
+	reactor.lock.Lock()
+	defer reactor.lock.Unlock()
+	reactor.requests++
+	var before = int(float64(reactor.requests-1) * reactor.failureRate)
+	var after = int(float64(reactor.requests) * reactor.failureRate)
+	return after > before
+}
+
+func (reactor *fakeReactor) wait(request *http.Request) error {
+	if reactor.latency <= 0 {
+		return nil
+	}
+	var timer = time.NewTimer(reactor.latency)
+	defer timer.Stop()
+	select {
+	case <-request.Context().Done():
+		return request.Context().Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+func decodeFakeImage(encoded string) (image.Image, error) {
+	var _, data, found = strings.Cut(encoded, ";base64,")
+	if !found {
+		data = encoded
+	}
+	var imageBytes, decodeError = base64.StdEncoding.DecodeString(data)
+	if decodeError != nil {
+		return nil, decodeError
+	}
+	var decodedImage, _, imageError = image.Decode(bytes.NewReader(imageBytes))
+	return decodedImage, imageError
+}
+
+func transformFakeImage(decodedImage image.Image) ([]byte, error) {
+	var bounds = decodedImage.Bounds()
+	var outputImage = image.NewGray(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	for y := 0; y < bounds.Dy(); y++ {
+		for x := 0; x < bounds.Dx(); x++ {
+			outputImage.Set(
+				bounds.Dx()-1-x,
+				y,
+				color.GrayModel.Convert(
+					decodedImage.At(
+						bounds.Min.X+x,
+						bounds.Min.Y+y,
+					),
+				),
+			)
+		}
+	}
+	var buffer bytes.Buffer
+	var pngError = png.Encode(&buffer, outputImage)
+	return buffer.Bytes(), pngError
+}
+
+func writeFakeResponse(responseWriter http.ResponseWriter, status int, body interface{}) {
+	responseWriter.Header().Set("Content-Type", "application/json")
+	responseWriter.WriteHeader(status)
+	json.NewEncoder(responseWriter).Encode(body)
+}
+
+func (reactor *fakeReactor) imageHandler(responseWriter http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodPost {
+		writeFakeResponse(responseWriter, http.StatusMethodNotAllowed, map[string]string{"detail": "Method Not Allowed"})
+		return
+	}
+	if reactor.wait(request) != nil {
+		return
+	}
+	if reactor.shouldFail() {
+		writeFakeResponse(responseWriter, reactor.failureStatus, map[string]string{"detail": "injected failure"})
+		return
+	}
+	var swap reactorRequest
+	var swapError = json.NewDecoder(request.Body).Decode(&swap)
+	if swapError != nil {
+		writeFakeResponse(responseWriter, http.StatusBadRequest, map[string]string{"detail": swapError.Error()})
+		return
+	}
+	if swap.SelectSource == 0 && swap.SourceImage == "" {
+		writeFakeResponse(responseWriter, http.StatusBadRequest, map[string]string{"detail": "source_image is required"})
+		return
+	}
+	if swap.SelectSource == 1 && !reactor.hasFaceModel(swap.FaceModel) {
+		writeFakeResponse(responseWriter, http.StatusBadRequest, map[string]string{"detail": fmt.Sprintf("face model %s not found", swap.FaceModel)})
+		return
+	}
+	var targetImage, targetError = decodeFakeImage(swap.TargetImage)
+	if targetError != nil {
+		writeFakeResponse(responseWriter, http.StatusBadRequest, map[string]string{"detail": fmt.Sprint("invalid target_image: ", targetError.Error())})
+		return
+	}
+	var outputBytes, outputError = transformFakeImage(targetImage)
+	if outputError != nil {
+		writeFakeResponse(responseWriter, http.StatusInternalServerError, map[string]string{"detail": outputError.Error()})
+		return
+	}
+	writeFakeResponse(responseWriter, http.StatusOK, reactorResponse{
+		Image: base64.StdEncoding.EncodeToString(outputBytes),
+	})
+}
+
+func (reactor *fakeReactor) hasFaceModel(faceModel string) bool {
+	reactor.lock.Lock()
+	defer reactor.lock.Unlock()
+	var name = strings.TrimSuffix(faceModel, ".safetensors")
+	return name == DEFAULT_FACE_MODEL_NAME || reactor.faceModels[name]
+}
+
+func (reactor *fakeReactor) getFaceModels() []string {
+	reactor.lock.Lock()
+	defer reactor.lock.Unlock()
+	var names = []string{DEFAULT_FACE_MODEL_NAME}
+	for name := range reactor.faceModels {
+		if name != DEFAULT_FACE_MODEL_NAME {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return append([]string{"None"}, names...)
+}
+
+func getFakeFaceModel(name string, sources int) []byte {
+	var header, _ = json.Marshal(map[string]interface{}{
+		"__metadata__": map[string]string{
+			"name":    name,
+			"sources": fmt.Sprint(sources),
+		},
+		"embedding": map[string]interface{}{
+			"dtype":        "F32",
+			"shape":        []int{1},
+			"data_offsets": []int{0, 4},
+		},
+	})
+	var content = binary.LittleEndian.AppendUint64(nil, uint64(len(header)))
+	content = append(content, header...)
+	return append(content, 0, 0, 0, 0)
+}
+
+func (reactor *fakeReactor) faceModelsHandler(responseWriter http.ResponseWriter, request *http.Request) {
+	if request.Method == http.MethodGet {
+		writeFakeResponse(responseWriter, http.StatusOK, faceModelListResponse{
+			FaceModels: reactor.getFaceModels(),
+		})
+		return
+	}
+	if request.Method != http.MethodPost {
+		writeFakeResponse(responseWriter, http.StatusMethodNotAllowed, map[string]string{"detail": "Method Not Allowed"})
+		return
+	}
+	if reactor.wait(request) != nil {
+		return
+	}
+	if reactor.shouldFail() {
+		writeFakeResponse(responseWriter, reactor.failureStatus, map[string]string{"detail": "injected failure"})
+		return
+	}
+	var build faceModelRequest
+	var buildError = json.NewDecoder(request.Body).Decode(&build)
+	if buildError == nil && (build.Name == "" || len(build.SourceImages) == 0) {
+		buildError = errors.New("name and source_images are required")
+	}
+	for _, sourceImage := range build.SourceImages {
+		if buildError != nil {
+			break
+		}
+		_, buildError = decodeFakeImage(sourceImage)
+	}
+	if buildError != nil {
+		writeFakeResponse(responseWriter, http.StatusBadRequest, map[string]string{"detail": buildError.Error()})
+		return
+	}
+	if reactor.facesDir != "" {
+		var writeError = os.WriteFile(
+			filepath.Join(reactor.facesDir, getFaceModelFile(build.Name)),
+			getFakeFaceModel(build.Name, len(build.SourceImages)),
+			0644,
+		)
+		if writeError != nil {
+			writeFakeResponse(responseWriter, http.StatusInternalServerError, map[string]string{"detail": writeError.Error()})
+			return
+		}
+	}
+	reactor.lock.Lock()
+	reactor.faceModels[build.Name] = true
+	reactor.lock.Unlock()
+	writeFakeResponse(responseWriter, http.StatusOK, faceModelResponse{
+		FaceModel: getFaceModelFile(build.Name),
+	})
+}
+
+func runFakeReactor(args []string) error {
+	var flags = flag.NewFlagSet("fake-reactor", flag.ContinueOnError)
+	var address = flags.String("addr", ":7860", "listen address")
+	var latency = flags.Duration("latency", 0, "delay added to every image and face model request")
+	var failureRate = flags.Float64("failure-rate", 0, "fraction of requests answered with -failure-status, between 0 and 1")
+	var failureStatus = flags.Int("failure-status", http.StatusServiceUnavailable, "status code returned for injected failures")
+	var facesDir = flags.String("faces-dir", "", "directory the built face models are written to, like ReActor's models/reactor/faces")
+	var parseError = flags.Parse(args)
+	if parseError != nil {
+		return parseError
+	}
+	if *failureRate < 0 || *failureRate > 1 {
+		return fmt.Errorf("failure-rate must be between 0 and 1, got %v", *failureRate)
+	}
+	var reactor = newFakeReactor(*latency, *failureRate, *failureStatus)
+	reactor.facesDir = *facesDir
+	fmt.Printf("Fake ReActor listening on %s\n", *address)
+	return http.ListenAndServe(*address, reactor.handler())
+}
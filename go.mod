@@ -4,7 +4,10 @@ go 1.23
 
 toolchain go1.23.2
 
-require github.com/zhongjie-cai/web-server v1.2.5
+require (
+	github.com/zhongjie-cai/web-server v1.2.5
+	gopkg.in/yaml.v3 v3.0.1
+)
 
 require (
 	github.com/google/uuid v1.6.0 // indirect
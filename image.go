@@ -3,28 +3,41 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"image"
+	"image/draw"
 	"image/jpeg"
 	"image/png"
-	"net/http"
+	"sort"
+	"sync"
 	"time"
+
+	webserver "github.com/zhongjie-cai/web-server"
 )
 
 const IMAGE_PREFIX string = "data:image/png;base64,"
 
 type reactorRequest struct {
-	TargetImage  string `json:"target_image"`
-	FaceRestorer string `json:"face_restorer"`
-	GenderSource int    `json:"gender_source"`
-	GenderTarget int    `json:"gender_target"`
-	Device       string `json:"device"`
-	MaskFace     int    `json:"mask_face"`
-	SelectSource int    `json:"select_source"`
-	FaceModel    string `json:"face_model"`
-	CodeFormerWeight float64 `json:"codeformer_weight"`
+	TargetImage        string  `json:"target_image"`
+	FaceRestorer       string  `json:"face_restorer"`
+	RestorerVisibility float64 `json:"restorer_visibility"`
+	Upscaler           string  `json:"upscaler"`
+	Scale              float64 `json:"scale"`
+	UpscaleVisibility  float64 `json:"upscale_visibility"`
+	SourceFacesIndex   []int   `json:"source_faces_index"`
+	FacesIndex         []int   `json:"face_index"`
+	GenderSource       int     `json:"gender_source"`
+	GenderTarget       int     `json:"gender_target"`
+	Device             string  `json:"device"`
+	MaskFace           int     `json:"mask_face"`
+	SelectSource       int     `json:"select_source"`
+	SourceImage        string  `json:"source_image,omitempty"`
+	FaceModel          string  `json:"face_model"`
+	CodeFormerWeight   float64 `json:"codeformer_weight"`
 }
 
 type reactorResponse struct {
@@ -38,7 +51,7 @@ type imageBytes struct {
 
 func flipImage(imageBytes []byte, quality int) ([]byte, error) {
 	var reader = bytes.NewReader(imageBytes)
-	var decodedImage, decodeErr = png.Decode(reader)
+	var decodedImage, _, decodeErr = image.Decode(reader)
 	if decodeErr != nil {
 		return nil, decodeErr
 	}
@@ -72,6 +85,45 @@ func flipImage(imageBytes []byte, quality int) ([]byte, error) {
 	return buffer.Bytes(), nil
 }
 
+func combineSourceImages(sourceImageBytes []imageBytes) ([]byte, error) {
+	if len(sourceImageBytes) == 1 {
+		return sourceImageBytes[0].bytes, nil
+	}
+	var decodedImages = make([]image.Image, 0, len(sourceImageBytes))
+	var width, height = 0, 0
+	for _, source := range sourceImageBytes {
+		var decodedImage, _, decodeErr = image.Decode(bytes.NewReader(source.bytes))
+		if decodeErr != nil {
+			return nil, fmt.Errorf("source_image %s is not a PNG or JPEG image: %w", source.name, decodeErr)
+		}
+		var bounds = decodedImage.Bounds()
+		width += bounds.Dx()
+		if bounds.Dy() > height {
+			height = bounds.Dy()
+		}
+		decodedImages = append(decodedImages, decodedImage)
+	}
+	var outputImage = image.NewRGBA(image.Rect(0, 0, width, height))
+	var offset = 0
+	for _, decodedImage := range decodedImages {
+		var bounds = decodedImage.Bounds()
+		draw.Draw(
+			outputImage,
+			image.Rect(offset, 0, offset+bounds.Dx(), bounds.Dy()),
+			decodedImage,
+			bounds.Min,
+			draw.Src,
+		)
+		offset += bounds.Dx()
+	}
+	var buffer bytes.Buffer
+	var pngErr = png.Encode(&buffer, outputImage)
+	if pngErr != nil {
+		return nil, pngErr
+	}
+	return buffer.Bytes(), nil
+}
+
 func getImageName(namePrefix string) string {
 	var now = time.Now()
 	return fmt.Sprintf(
@@ -83,97 +135,305 @@ func getImageName(namePrefix string) string {
 }
 
 func getErrorBytes(originalName string, errorData error) *imageBytes {
+	if errors.Is(errorData, context.DeadlineExceeded) {
+		return &imageBytes{
+			name:  fmt.Sprintf("%v.timeout.log", originalName),
+			bytes: []byte(fmt.Sprintf("Timed out processing file %v: %v", originalName, errorData.Error())),
+		}
+	}
 	return &imageBytes{
 		name: fmt.Sprintf("%v.error.log", originalName),
 		bytes: []byte(fmt.Sprintf("Failed processing file %v: %v", originalName, errorData.Error())),
 	}
 }
 
+func callReactor(
+	ctx context.Context,
+	targetImage imageBytes,
+	namePrefix string,
+	reactorAPI string,
+	quality int,
+	options reactorOptions,
+) (*imageBytes, []imageAttempt, error) {
+	var tarImage = IMAGE_PREFIX + base64.StdEncoding.EncodeToString(
+		targetImage.bytes,
+	)
+	var srcImage string
+	if options.SelectSource == 0 {
+		srcImage = IMAGE_PREFIX + base64.StdEncoding.EncodeToString(
+			options.sourceImage,
+		)
+	}
+	var content, contentError = json.Marshal(
+		reactorRequest{
+			TargetImage:        tarImage,
+			FaceRestorer:       options.FaceRestorer,
+			RestorerVisibility: options.RestorerVisibility,
+			Upscaler:           options.Upscaler,
+			Scale:              options.Scale,
+			UpscaleVisibility:  options.UpscaleVisibility,
+			SourceFacesIndex:   options.SourceFacesIndex,
+			FacesIndex:         options.FacesIndex,
+			GenderSource:       options.GenderSource,
+			GenderTarget:       options.GenderTarget,
+			Device:             options.Device,
+			MaskFace:           options.MaskFace,
+			SelectSource:       options.SelectSource,
+			SourceImage:        srcImage,
+			FaceModel:          options.FaceModel,
+			CodeFormerWeight:   options.CodeFormerWeight,
+		},
+	)
+	if contentError != nil {
+		return nil, nil, contentError
+	}
+	var responseBytes, attempts, responseError = postReactorWithRetry(
+		ctx,
+		reactorAPI,
+		"application/json",
+		content,
+	)
+	if responseError != nil {
+		return nil, attempts, responseError
+	}
+	var respImg reactorResponse
+	var respImgError = json.Unmarshal(responseBytes, &respImg)
+	if respImgError != nil {
+		return nil, attempts, respImgError
+	}
+	var resultImg, resultImgError = base64.StdEncoding.DecodeString(
+		respImg.Image,
+	)
+	if resultImgError != nil {
+		return nil, attempts, resultImgError
+	}
+	var flipImg, flipImgError = flipImage(resultImg, quality)
+	if flipImgError != nil {
+		return nil, attempts, flipImgError
+	}
+	return &imageBytes{
+		bytes: flipImg,
+		name:  getImageName(namePrefix),
+	}, attempts, nil
+}
+
+func recordImageOutcome(counter int, index int, outcome imageOutcome) {
+	if counter == 0 {
+		return
+	}
+	jobs.Update(
+		counter,
+		func(job *job) {
+			if index < len(job.Images) {
+				job.Images[index] = outcome
+			}
+			job.Current++
+		},
+	)
+}
+
+func recordImageFailure(counter int, index int, outcome imageOutcome, failure error) imageBytes {
+	var errorBytes = getErrorBytes(outcome.Name, failure)
+	outcome.Output = errorBytes.name
+	outcome.Error = failure.Error()
+	if errors.Is(failure, context.DeadlineExceeded) {
+		outcome.TimedOut = true
+		outcome.Error = fmt.Sprint("timed out: ", failure.Error())
+	}
+	recordImageOutcome(counter, index, outcome)
+	return *errorBytes
+}
+
+func getImageContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if appConfig.ImageTimeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, appConfig.ImageTimeout)
+}
+
+func recordImageCanceled(counter int, index int, name string) {
+	if counter == 0 {
+		return
+	}
+	jobs.Update(
+		counter,
+		func(job *job) {
+			if index < len(job.Images) {
+				job.Images[index] = imageOutcome{
+					Name:  name,
+					Error: "canceled",
+				}
+			}
+		},
+	)
+}
+
+func getAllIndexes(count int) []int {
+	var indexes = make([]int, count)
+	for index := range indexes {
+		indexes[index] = index
+	}
+	return indexes
+}
+
 func processImage(
+	ctx context.Context,
+	imageProcessor processor,
 	targetImageBytes []imageBytes,
+	indexes []int,
 	namePrefix string,
 	reactorAPI string,
 	quality int,
-	weight float64,
-	progress *progress,
-) []imageBytes {
-	var count = len(targetImageBytes)
-	var allBytes = make([]imageBytes, 0, count)
-	for i := 0; i < count; i++ {
-		if progress != nil {
-			progress.current = i + 1
-		}
-		var originalName = targetImageBytes[i].name
-		var tarImage = IMAGE_PREFIX + base64.StdEncoding.EncodeToString(
-			targetImageBytes[i].bytes,
-		)
-		var content, contentError = json.Marshal(
-			reactorRequest{
-				TargetImage:  tarImage,
-				FaceRestorer: "CodeFormer",
-				Device:       "CUDA",
-				MaskFace:     1,
-				GenderSource: 1,
-				GenderTarget: 1,
-				CodeFormerWeight: weight,
-				SelectSource: 1,
-				FaceModel: "origin.safetensors",
-			},
-		)
-		if contentError != nil {
-			var errorBytes = getErrorBytes(originalName, contentError)
-			allBytes = append(allBytes, *errorBytes)
-			continue
-		}
-		var body = bytes.NewReader(content)
-		var request, requestError = http.NewRequest(
-			http.MethodPost,
-			reactorAPI,
-			body,
-		)
-		if requestError != nil {
-			var errorBytes = getErrorBytes(originalName, requestError)
-			allBytes = append(allBytes, *errorBytes)
-			continue
-		}
-		var response, responseError = http.DefaultClient.Do(request)
-		if responseError != nil {
-			var errorBytes = getErrorBytes(originalName, responseError)
-			allBytes = append(allBytes, *errorBytes)
-			continue
-		}
-		if response.StatusCode != http.StatusOK {
-			var errorBytes = getErrorBytes(originalName, fmt.Errorf("wrong response [%d]: {%s}", response.StatusCode, response.Status))
-			allBytes = append(allBytes, *errorBytes)
-			continue
+	options reactorOptions,
+	counter int,
+	control *jobControl,
+	archive *archiveWriter,
+) ([]imageBytes, []int, error) {
+	var results = make([]imageBytes, len(targetImageBytes))
+	var waitGroup sync.WaitGroup
+	var batchCtx, cancelBatch = context.WithCancel(ctx)
+	defer cancelBatch()
+	var archiveOnce sync.Once
+	var archiveError error
+	var addToArchive = func(result imageBytes) {
+		if archive == nil {
+			return
 		}
-		var buffer = &bytes.Buffer{}
-		buffer.ReadFrom(response.Body)
-		var respImg reactorResponse
-		var respImgError = json.Unmarshal(buffer.Bytes(), &respImg)
-		if respImgError != nil {
-			var errorBytes = getErrorBytes(originalName, respImgError)
-			allBytes = append(allBytes, *errorBytes)
-			continue
+		var addError = archive.add(result)
+		if addError != nil {
+			archiveOnce.Do(func() {
+				archiveError = addError
+				cancelBatch()
+			})
 		}
-		var resultImg, resultImgError = base64.StdEncoding.DecodeString(
-			respImg.Image,
-		)
-		if resultImgError != nil {
-			var errorBytes = getErrorBytes(originalName, respImgError)
-			allBytes = append(allBytes, *errorBytes)
-			continue
+	}
+	var pendingLock sync.Mutex
+	var pending = []int{}
+	for _, i := range indexes {
+		waitGroup.Add(1)
+		go func(index int) {
+			defer waitGroup.Done()
+			var slot, waitError = acquireUnpaused(batchCtx, control, reactorAPI)
+			if errors.Is(waitError, errJobPaused) {
+				pendingLock.Lock()
+				pending = append(pending, index)
+				pendingLock.Unlock()
+				return
+			}
+			if errors.Is(waitError, context.DeadlineExceeded) {
+				results[index] = recordImageFailure(
+					counter,
+					index,
+					imageOutcome{
+						Name: targetImageBytes[index].name,
+					},
+					waitError,
+				)
+				addToArchive(results[index])
+				return
+			}
+			if waitError != nil {
+				recordImageCanceled(counter, index, targetImageBytes[index].name)
+				return
+			}
+			defer slot.release()
+			results[index] = processSingleImage(
+				withEndpointSlot(batchCtx, slot),
+				imageProcessor,
+				targetImageBytes[index],
+				namePrefix,
+				reactorAPI,
+				quality,
+				options,
+				counter,
+				index,
+			)
+			if results[index].name != "" {
+				addToArchive(results[index])
+			}
+		}(i)
+	}
+	waitGroup.Wait()
+	sort.Ints(pending)
+	var processed = make([]imageBytes, 0, len(indexes))
+	for _, result := range results {
+		if result.name != "" {
+			processed = append(processed, result)
 		}
-		var flipImg, flipImgError = flipImage(resultImg, quality)
-		if flipImgError != nil {
-			var errorBytes = getErrorBytes(originalName, flipImgError)
-			allBytes = append(allBytes, *errorBytes)
-			continue
+	}
+	return processed, pending, archiveError
+}
+
+func acquireUnpaused(ctx context.Context, control *jobControl, reactorAPI string) (*endpointSlot, error) {
+	if control.isPaused() {
+		return nil, errJobPaused
+	}
+	var slot, acquireError = endpoints.acquire(ctx, reactorAPI)
+	if acquireError != nil {
+		return nil, acquireError
+	}
+	if control.isPaused() {
+		slot.release()
+		return nil, errJobPaused
+	}
+	return slot, nil
+}
+
+func processSingleImage(
+	ctx context.Context,
+	imageProcessor processor,
+	targetImage imageBytes,
+	namePrefix string,
+	reactorAPI string,
+	quality int,
+	options reactorOptions,
+	counter int,
+	index int,
+) imageBytes {
+	var originalName = targetImage.name
+	var startedAt = time.Now()
+	var outcome = imageOutcome{
+		Name:      originalName,
+		StartedAt: &startedAt,
+	}
+	var imageCtx, cancelImage = getImageContext(ctx)
+	defer cancelImage()
+	var result, attempts, resultError = imageProcessor.Process(
+		imageCtx,
+		targetImage,
+		namePrefix,
+		reactorAPI,
+		quality,
+		options,
+	)
+	getEndpointSlot(ctx).release()
+	var finishedAt = time.Now()
+	outcome.FinishedAt = &finishedAt
+	outcome.Attempts = attempts
+	if resultError != nil && ctx.Err() == context.Canceled {
+		recordImageCanceled(counter, index, originalName)
+		return imageBytes{}
+	}
+	if resultError != nil {
+		return recordImageFailure(counter, index, outcome, resultError)
+	}
+	outcome.Output = result.name
+	if counter != 0 {
+		var saveError = saveJobResult(counter, index, *result, &outcome)
+		if saveError != nil {
+			outcome.ResultError = saveError.Error()
+			logBackgroundLogic(
+				ctx,
+				webserver.LogLevelError,
+				"image",
+				"processSingleImage",
+				"Unable to save result %d of job %d: %v",
+				index,
+				counter,
+				saveError,
+			)
 		}
-		allBytes = append(allBytes, imageBytes{
-			bytes: flipImg,
-			name:  getImageName(namePrefix),
-		})
 	}
-	return allBytes
+	recordImageOutcome(counter, index, outcome)
+	return *result
 }
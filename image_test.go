@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+type blockingProcessor struct{}
+
+func (blockingProcessor) Name() string {
+	return "blocking"
+}
+
+func (blockingProcessor) Endpoint(requested string) (string, error) {
+	return requested, nil
+}
+
+func (blockingProcessor) Process(
+	ctx context.Context,
+	targetImage imageBytes,
+	namePrefix string,
+	endpoint string,
+	quality int,
+	options reactorOptions,
+) (*imageBytes, []imageAttempt, error) {
+	<-ctx.Done()
+	return nil, nil, ctx.Err()
+}
+
+func TestProcessSingleImageTimesOut(t *testing.T) {
+	useTestStorage(t)
+	appConfig.ImageTimeout = 20 * time.Millisecond
+	var counter, err = jobs.Create(&job{Images: make([]imageOutcome, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var result = processSingleImage(
+		context.Background(),
+		blockingProcessor{},
+		imageBytes{name: "slow.jpg", bytes: getTestPNG(t)},
+		"",
+		"",
+		90,
+		reactorOptions{},
+		counter,
+		0,
+	)
+	if result.name == "" {
+		t.Fatal("a timed out image should produce an error file")
+	}
+	var stored, _ = jobs.Get(counter)
+	var outcome = stored.Images[0]
+	if !outcome.TimedOut || !strings.HasPrefix(outcome.Error, "timed out: ") {
+		t.Fatalf("expected a timed out outcome, got %+v", outcome)
+	}
+	if stored.Current != 1 {
+		t.Fatalf("a timed out image still counts as processed, got %d", stored.Current)
+	}
+}
+
+func TestProcessSingleImageCanceled(t *testing.T) {
+	useTestStorage(t)
+	appConfig.ImageTimeout = 0
+	var counter, err = jobs.Create(&job{Images: make([]imageOutcome, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	var result = processSingleImage(
+		ctx,
+		blockingProcessor{},
+		imageBytes{name: "slow.jpg", bytes: getTestPNG(t)},
+		"",
+		"",
+		90,
+		reactorOptions{},
+		counter,
+		0,
+	)
+	if result.name != "" {
+		t.Fatalf("a canceled image should produce nothing, got %q", result.name)
+	}
+	var stored, _ = jobs.Get(counter)
+	if outcome := stored.Images[0]; outcome.Error != "canceled" || outcome.TimedOut {
+		t.Fatalf("expected a canceled outcome, got %+v", outcome)
+	}
+}
+
+func TestGetBatchContextHonoursBatchTimeout(t *testing.T) {
+	useTestConfig(t)
+	appConfig.BatchTimeout = time.Minute
+	var ctx, cancel = getBatchContext(context.Background())
+	defer cancel()
+	if _, ok := ctx.Deadline(); !ok {
+		t.Fatal("a batch timeout should set a deadline")
+	}
+	appConfig.BatchTimeout = 0
+	var unbounded, cancelUnbounded = getBatchContext(context.Background())
+	defer cancelUnbounded()
+	if _, ok := unbounded.Deadline(); ok {
+		t.Fatal("no batch timeout should leave the batch unbounded")
+	}
+}
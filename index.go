@@ -1,11 +1,12 @@
 package main
 
 import (
+	"errors"
 	"fmt"
+	"html"
 	"net"
 	"net/http"
 	"os"
-	"sort"
 	"strings"
 	"time"
 
@@ -28,6 +29,18 @@ const INDEX_PAGE_CONTENT string = `<html>
 	%s
 	</div>
 	<br />
+	<label>--== Retention ==--</label>
+	<br />
+	<div>
+	%s
+	</div>
+	<br />
+	<label>--== Backends ==--</label>
+	<br />
+	<div>
+	%s
+	</div>
+	<br />
 	<label>--== Swapper ==--</label>
 	<br />
     <form action="/process" method="POST" enctype="multipart/form-data">
@@ -39,9 +52,14 @@ const INDEX_PAGE_CONTENT string = `<html>
       <input type="text" id="name_prefix"
         name="name_prefix" value="IMG" />
       <br />
+      <label>Processor:&nbsp;</label>
+      <input type="text" id="processor"
+        name="processor" value="reactor" />
+      <a href="./processors">List processors</a>
+      <br />
       <label>Reactor API:&nbsp;</label>
       <input type="text" id="reactor_api" name="reactor_api"
-	    value="http://localhost:7860/reactor/image" />
+	    placeholder="http://localhost:7860/reactor/image" />
       <br />
       <label>Quality:&nbsp;</label>
       <input type="text" id="quality"
@@ -51,9 +69,38 @@ const INDEX_PAGE_CONTENT string = `<html>
       <input type="text" id="batches"
         name="batches" value="1" />
       <br />
+      <label>Preset:&nbsp;</label>
+      <input type="text" id="preset"
+        name="preset" value="default" />
+      <br />
+      <label>Face model:&nbsp;</label>
+      <input type="text" id="face_model"
+        name="face_model" placeholder="origin.safetensors" />
+      <a href="./models">List models</a>
+      <br />
+      <label>Source image:&nbsp;</label>
+      <input type="file" id="source_image" name="source_image"
+        multiple="multiple" />
+      <br />
+      <label>Face restorer:&nbsp;</label>
+      <input type="text" id="face_restorer"
+        name="face_restorer" placeholder="CodeFormer" />
+      <br />
+      <label>Device:&nbsp;</label>
+      <input type="text" id="device"
+        name="device" placeholder="CUDA" />
+      <br />
+      <label>Options JSON:&nbsp;</label>
+      <input type="text" id="options"
+        name="options" placeholder="{}" />
+      <br />
       <label>CodeFormer Weight:&nbsp;</label>
       <input type="text" id="codeformerweight"
-        name="codeformerweight" value="0.5" />
+        name="codeformerweight" placeholder="0.5" />
+      <br />
+      <label>Priority:&nbsp;</label>
+      <input type="text" id="priority"
+        name="priority" value="0" />
       <br />
       <input type="submit" />
       <br />
@@ -72,9 +119,30 @@ const INDEX_PAGE_CONTENT string = `<html>
       <input type="file" id="face_image" name="face_image"
         multiple="multiple" />
       <br />
+      <label>Model name:&nbsp;</label>
+      <input type="text" id="model_name"
+        name="model_name" value="origin" />
+      <br />
       <label>Reactor API:&nbsp;</label>
       <input type="text" id="reactor_api" name="reactor_api"
-	    value="http://localhost:7860/reactor/facemodels" />
+	    placeholder="http://localhost:7860/reactor/facemodels" />
+      <br />
+      <input type="submit" />
+      <br />
+    </form>
+	<br />
+
+	<label>--== Model Library ==--</label>
+	<br />
+    <form action="/library" method="POST" enctype="multipart/form-data">
+      <label>Model file:&nbsp;</label>
+      <input type="file" id="model" name="model"
+        accept=".safetensors" />
+      <br />
+      <label>Model name:&nbsp;</label>
+      <input type="text" id="library_model_name"
+        name="model_name" placeholder="file name" />
+      <a href="./library">List library</a>
       <br />
       <input type="submit" />
       <br />
@@ -115,44 +183,85 @@ func getServerIPsHtml(session webserver.Session) string {
 	return builder.String()
 }
 
-func getListOfProgressesHtml() string {
-	var progresses = []*progress{}
-	statusListLock.RLock()
-	for _, progress := range statusList {
-		progresses = append(progresses, progress)
+func getJobThumbnailsHtml(entry *job) string {
+	var builder strings.Builder
+	for _, outcome := range entry.Images {
+		if outcome.ThumbnailURL == "" {
+			continue
+		}
+		builder.WriteString(
+			fmt.Sprintf(
+				"<a href=\"%s\"><img src=\"%s\" alt=\"%s\" title=\"%s\" style=\"max-height: 96px; margin: 2px;\" /></a>",
+				html.EscapeString(outcome.DownloadURL),
+				html.EscapeString(outcome.ThumbnailURL),
+				html.EscapeString(outcome.Name),
+				html.EscapeString(outcome.Name),
+			),
+		)
 	}
-	statusListLock.RUnlock()
-	sort.SliceStable(
-		progresses,
-		func(i, j int) bool {
-			return progresses[i].counter < progresses[j].counter
-		},
-	)
+	if builder.Len() == 0 {
+		return ""
+	}
+	return fmt.Sprint("<br />", builder.String())
+}
+
+func getListOfProgressesHtml() string {
 	var builder strings.Builder
-	for _, entry := range progresses {
-		if entry.file != "" {
-			if _, err := os.Stat(entry.file); err != nil {
-				statusListLock.Lock()
-				delete(statusList, entry.counter)
-				statusListLock.Unlock()
-			} else {
+	for _, entry := range listJobsWithPositions() {
+		if entry.File != "" {
+			if _, err := outputs.Stat(entry.File); !errors.Is(err, os.ErrNotExist) {
 				builder.WriteString(
 					fmt.Sprintf(
 						"<p>%04d&nbsp;-&nbsp;%s<br /><a href=\".\\dl\\%d\">Download Only</a>&nbsp;&nbsp;-&nbsp;&nbsp;<a href=\".\\dnd\\%d\">Download & Delete</a></p>",
-						entry.counter,
-						entry.file,
-						entry.counter,
-						entry.counter,
+						entry.Counter,
+						html.EscapeString(entry.File),
+						entry.Counter,
+						entry.Counter,
 					),
 				)
 			}
+		} else if entry.State == JOB_STATE_CANCELED {
+			builder.WriteString(
+				fmt.Sprintf(
+					"<p>%04d - Canceled</p>",
+					entry.Counter,
+				),
+			)
+		} else if entry.FinishedAt != nil {
+			builder.WriteString(
+				fmt.Sprintf(
+					"<p>%04d - Failed: %s</p>",
+					entry.Counter,
+					html.EscapeString(entry.Error),
+				),
+			)
+		} else if entry.State == JOB_STATE_PAUSED {
+			builder.WriteString(
+				fmt.Sprintf(
+					"<p>%04d - Paused ( %d / %d )%s</p>",
+					entry.Counter,
+					entry.Current,
+					entry.Total,
+					getJobThumbnailsHtml(entry),
+				),
+			)
+		} else if entry.State == JOB_STATE_QUEUED {
+			builder.WriteString(
+				fmt.Sprintf(
+					"<p>%04d - Queued ( #%d in queue, %d images )</p>",
+					entry.Counter,
+					entry.QueuePosition,
+					entry.Total,
+				),
+			)
 		} else {
 			builder.WriteString(
 				fmt.Sprintf(
-					"<p>%04d - In progress ( %d / %d )</p>",
-					entry.counter,
-					entry.current,
-					entry.total,
+					"<p>%04d - In progress ( %d / %d )%s</p>",
+					entry.Counter,
+					entry.Current,
+					entry.Total,
+					getJobThumbnailsHtml(entry),
 				),
 			)
 		}
@@ -163,10 +272,82 @@ func getListOfProgressesHtml() string {
 	return builder.String()
 }
 
+func getRetentionHtml() string {
+	if !isRetentionEnabled() {
+		return "No retention policy configured, archives are kept until downloaded and deleted."
+	}
+	var plan, planError = getRetentionPlan(time.Now())
+	if planError != nil {
+		return html.EscapeString(fmt.Sprint("Unable to compute retention plan: ", planError.Error()))
+	}
+	var builder strings.Builder
+	builder.WriteString(
+		fmt.Sprintf(
+			"<p>%d archives using %d bytes (max age %s, max %d bytes, max %d archives, 0 means unlimited)</p>",
+			plan.TotalCount,
+			plan.TotalSize,
+			appConfig.RetentionAge,
+			appConfig.RetentionMaxBytes,
+			appConfig.RetentionMaxCount,
+		),
+	)
+	var nextRun = "at the next cleanup"
+	if plan.NextRunAt != nil {
+		nextRun = fmt.Sprint("at ", plan.NextRunAt.Format("2006-01-02 15:04:05"))
+	}
+	if len(plan.Purge) == 0 {
+		builder.WriteString("<p>Nothing will be purged " + nextRun + ".</p>")
+		return builder.String()
+	}
+	builder.WriteString("<p>Will be purged " + nextRun + ":</p>")
+	for _, candidate := range plan.Purge {
+		builder.WriteString(
+			fmt.Sprintf(
+				"<p>%04d&nbsp;-&nbsp;%s ( %d bytes, exceeds %s limit )</p>",
+				candidate.Counter,
+				html.EscapeString(candidate.File),
+				candidate.Size,
+				candidate.Reason,
+			),
+		)
+	}
+	return builder.String()
+}
+
+func getBackendStatsHtml() string {
+	var stats = backends.stats()
+	if len(stats) == 0 {
+		return "No backend pool configured, using reactor_api from each request."
+	}
+	var builder strings.Builder
+	for _, entry := range stats {
+		var health = "healthy"
+		if !entry.Healthy {
+			health = "unhealthy"
+		}
+		builder.WriteString(
+			fmt.Sprintf(
+				"<p>%s&nbsp;-&nbsp;%s ( weight %d, %d in flight, %d requests, %d failures, avg %s )<br />%s</p>",
+				html.EscapeString(entry.URL),
+				health,
+				entry.Weight,
+				entry.InFlight,
+				entry.Requests,
+				entry.Failures,
+				entry.AverageLatency,
+				html.EscapeString(entry.LastError),
+			),
+		)
+	}
+	return builder.String()
+}
+
 func indexAction(session webserver.Session) (interface{}, error) {
 	var ipAddresses = getServerIPsHtml(session)
 	var listOfFiles = getListOfProgressesHtml()
-	var pageContent = fmt.Sprintf(INDEX_PAGE_CONTENT, ipAddresses, listOfFiles)
+	var retention = getRetentionHtml()
+	var backendStats = getBackendStatsHtml()
+	var pageContent = fmt.Sprintf(INDEX_PAGE_CONTENT, ipAddresses, retention, backendStats, listOfFiles)
 	var request = session.GetRequest()
 	var responseWriter = session.GetResponseWriter()
 	http.ServeContent(
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProgressListEscapesAndKeepsJobs(t *testing.T) {
+	useTestStorage(t)
+	var finishedAt = time.Now()
+	var missing, _ = jobs.Create(&job{
+		File:       "gone.cache.zip",
+		FinishedAt: &finishedAt,
+	})
+	jobs.Create(&job{
+		File:       "<b>x</b>.cache.zip",
+		FinishedAt: &finishedAt,
+	})
+	outputs.Put("<b>x</b>.cache.zip", []byte("archive"))
+	jobs.Create(&job{
+		State:      JOB_STATE_FAILED,
+		Error:      "<script>alert(1)</script>",
+		FinishedAt: &finishedAt,
+	})
+	var rendered = getListOfProgressesHtml()
+	if strings.Contains(rendered, "<script>") || strings.Contains(rendered, "<b>x</b>") {
+		t.Fatalf("job fields must be escaped: %s", rendered)
+	}
+	if !strings.Contains(rendered, "&lt;script&gt;") || !strings.Contains(rendered, "&lt;b&gt;x&lt;/b&gt;") {
+		t.Fatalf("escaped job fields should be shown: %s", rendered)
+	}
+	if _, found := jobs.Get(missing); !found {
+		t.Fatal("rendering must not delete jobs")
+	}
+}
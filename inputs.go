@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const JOB_SOURCE_FILE string = "source.png"
+
+func getInputsDir(counter int) string {
+	return getStorageName(appConfig.InputsDir, fmt.Sprintf("%04d", counter))
+}
+
+func getInputName(name string) string {
+	return path.Base(strings.ReplaceAll(name, "\\", "/"))
+}
+
+func getInputsKeptUntil() *time.Time {
+	var keptUntil = time.Now().Add(appConfig.InputRetention)
+	return &keptUntil
+}
+
+func saveJobInputs(counter int, targetImageBytes []imageBytes) error {
+	if appConfig.InputRetention <= 0 {
+		return nil
+	}
+	var dir = getInputsDir(counter)
+	for index, target := range targetImageBytes {
+		var name = getStorageName(
+			dir,
+			fmt.Sprintf("%04d_%s", index, getInputName(target.name)),
+		)
+		var writeError = outputs.Put(name, target.bytes)
+		if writeError != nil {
+			return writeError
+		}
+	}
+	return nil
+}
+
+func saveJobSource(counter int, options reactorOptions) error {
+	if appConfig.InputRetention <= 0 || len(options.sourceImage) == 0 {
+		return nil
+	}
+	return outputs.Put(getStorageName(getInputsDir(counter), JOB_SOURCE_FILE), options.sourceImage)
+}
+
+func loadJobSource(counter int) ([]byte, error) {
+	return outputs.Get(getStorageName(getInputsDir(counter), JOB_SOURCE_FILE))
+}
+
+func loadJobInputs(counter int) (map[int]imageBytes, error) {
+	var entries, entriesError = outputs.List(getInputsDir(counter) + "/")
+	if entriesError != nil {
+		return nil, entriesError
+	}
+	if len(entries) == 0 {
+		return nil, fmt.Errorf("inputs of job %d: %w", counter, os.ErrNotExist)
+	}
+	var inputs = map[int]imageBytes{}
+	for _, entry := range entries {
+		var prefix, name, found = strings.Cut(path.Base(entry.Name), "_")
+		if !found {
+			continue
+		}
+		var index, indexError = strconv.Atoi(prefix)
+		if indexError != nil {
+			continue
+		}
+		var fileBytes, fileBytesError = outputs.Get(entry.Name)
+		if fileBytesError != nil {
+			return nil, fileBytesError
+		}
+		inputs[index] = imageBytes{
+			bytes: fileBytes,
+			name:  name,
+		}
+	}
+	return inputs, nil
+}
+
+func deleteJobInputs(counter int) error {
+	var entries, entriesError = outputs.List(getInputsDir(counter) + "/")
+	if entriesError != nil {
+		return entriesError
+	}
+	for _, entry := range entries {
+		var deleteError = outputs.Delete(entry.Name)
+		if deleteError != nil {
+			return deleteError
+		}
+	}
+	return nil
+}
+
+func loadArchivedOutputs(filename string, names []string) ([]imageBytes, error) {
+	var wanted = map[string]bool{}
+	for _, name := range names {
+		wanted[name] = true
+	}
+	var reader, readerAt, readerError = openStorageArchive(filename)
+	if readerError != nil {
+		return nil, readerError
+	}
+	defer readerAt.Close()
+	var outputs = []imageBytes{}
+	for _, file := range reader.File {
+		if !wanted[file.Name] {
+			continue
+		}
+		var content, contentError = file.Open()
+		if contentError != nil {
+			return nil, contentError
+		}
+		var buffer bytes.Buffer
+		var _, copyError = io.Copy(&buffer, content)
+		content.Close()
+		if copyError != nil {
+			return nil, copyError
+		}
+		outputs = append(outputs, imageBytes{
+			bytes: buffer.Bytes(),
+			name:  file.Name,
+		})
+	}
+	return outputs, nil
+}
+
+func purgeExpiredInputs() {
+	var entries, entriesError = outputs.List(appConfig.InputsDir + "/")
+	if entriesError != nil {
+		return
+	}
+	var now = time.Now()
+	var checked = map[int]bool{}
+	for _, entry := range entries {
+		var dir, _, _ = strings.Cut(strings.TrimPrefix(entry.Name, appConfig.InputsDir+"/"), "/")
+		var counter, counterError = strconv.Atoi(dir)
+		if counterError != nil || checked[counter] {
+			continue
+		}
+		checked[counter] = true
+		var job, found = jobs.Get(counter)
+		if found && (job.InputsKeptUntil == nil || job.InputsKeptUntil.After(now)) {
+			continue
+		}
+		deleteJobInputs(counter)
+	}
+}
+
+func getFailedIndexes(job *job) []int {
+	var failed = []int{}
+	for index, outcome := range job.Images {
+		if outcome.Error != "" || outcome.FinishedAt == nil {
+			failed = append(failed, index)
+		}
+	}
+	sort.Ints(failed)
+	return failed
+}
+
+func getSucceededOutputs(job *job) []string {
+	var outputs = append([]string{}, job.CarriedOver...)
+	for _, outcome := range job.Images {
+		if outcome.Error == "" && outcome.Output != "" {
+			outputs = append(outputs, outcome.Output)
+		}
+	}
+	return outputs
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type failingGetStorage struct {
+	storage
+}
+
+func (failingGetStorage) Get(name string) ([]byte, error) {
+	return nil, errors.New("archives must be streamed, not read whole")
+}
+
+func TestLoadArchivedOutputsStreamsTheArchive(t *testing.T) {
+	useTestStorage(t)
+	var archive, _ = newArchiveWriter("IMG_0001.cache.zip")
+	archive.add(imageBytes{name: "a.jpg", bytes: []byte("first")})
+	archive.add(imageBytes{name: "b.jpg", bytes: []byte("second")})
+	archive.add(imageBytes{name: "c.jpg", bytes: []byte("third")})
+	var filename, closeErr = archive.close()
+	if closeErr != nil {
+		t.Fatal(closeErr)
+	}
+	outputs = failingGetStorage{outputs}
+	var loaded, err = loadArchivedOutputs(filename, []string{"a.jpg", "c.jpg"})
+	if err != nil || len(loaded) != 2 || string(loaded[0].bytes) != "first" || string(loaded[1].bytes) != "third" {
+		t.Fatalf("unexpected outputs %v %v", loaded, err)
+	}
+	if _, err := loadArchivedOutputs("missing.cache.zip", nil); err == nil {
+		t.Fatal("expected a missing archive to be reported")
+	}
+}
+
+func TestJobInputsRoundTrip(t *testing.T) {
+	useTestStorage(t)
+	appConfig.InputRetention = time.Hour
+	var saveErr = saveJobInputs(
+		7,
+		[]imageBytes{
+			{name: "nested/a.jpg", bytes: []byte("first")},
+			{name: "dir\\b_c.jpg", bytes: []byte("second")},
+		},
+	)
+	if saveErr != nil {
+		t.Fatal(saveErr)
+	}
+	if err := saveJobSource(7, reactorOptions{sourceImage: []byte("face")}); err != nil {
+		t.Fatal(err)
+	}
+	var inputs, err = loadJobInputs(7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var expected = map[int]imageBytes{
+		0: {name: "a.jpg", bytes: []byte("first")},
+		1: {name: "b_c.jpg", bytes: []byte("second")},
+	}
+	if !reflect.DeepEqual(inputs, expected) {
+		t.Fatalf("unexpected inputs %+v", inputs)
+	}
+	if source, err := loadJobSource(7); err != nil || string(source) != "face" {
+		t.Fatalf("unexpected source %q %v", source, err)
+	}
+	if err := deleteJobInputs(7); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadJobInputs(7); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("deleted inputs should be missing, got %v", err)
+	}
+}
+
+func TestJobInputsNotKeptWithoutRetention(t *testing.T) {
+	useTestStorage(t)
+	appConfig.InputRetention = 0
+	saveJobInputs(7, []imageBytes{{name: "a.jpg", bytes: []byte("first")}})
+	saveJobSource(7, reactorOptions{sourceImage: []byte("face")})
+	var objects, _ = outputs.List(appConfig.InputsDir + "/")
+	if len(objects) != 0 {
+		t.Fatalf("nothing should be kept, got %v", getObjectNames(objects))
+	}
+}
+
+func TestPurgeExpiredInputs(t *testing.T) {
+	useTestStorage(t)
+	appConfig.InputRetention = time.Hour
+	var expired = time.Now().Add(-time.Minute)
+	var kept = time.Now().Add(time.Hour)
+	var expiredCounter, _ = jobs.Create(&job{InputsKeptUntil: &expired})
+	var keptCounter, _ = jobs.Create(&job{InputsKeptUntil: &kept})
+	var runningCounter, _ = jobs.Create(&job{})
+	for _, counter := range []int{expiredCounter, keptCounter, runningCounter, 999} {
+		saveJobInputs(counter, []imageBytes{{name: "a.jpg", bytes: []byte("input")}})
+	}
+	purgeExpiredInputs()
+	for counter, want := range map[int]bool{expiredCounter: false, keptCounter: true, runningCounter: true, 999: false} {
+		var _, err = loadJobInputs(counter)
+		if (err == nil) != want {
+			t.Errorf("job %d: expected inputs kept=%v, got %v", counter, want, err)
+		}
+	}
+}
+
+func TestFailedIndexesAndSucceededOutputs(t *testing.T) {
+	var finished = time.Now()
+	var entry = &job{
+		CarriedOver: []string{"carried.jpg"},
+		Images: []imageOutcome{
+			{Output: "a.jpg", FinishedAt: &finished},
+			{Output: "b.error.txt", Error: "failed", FinishedAt: &finished},
+			{},
+			{Output: "d.jpg", FinishedAt: &finished},
+		},
+	}
+	if failed := getFailedIndexes(entry); !reflect.DeepEqual(failed, []int{1, 2}) {
+		t.Fatalf("unexpected failed indexes %v", failed)
+	}
+	var expected = []string{"carried.jpg", "a.jpg", "d.jpg"}
+	if succeeded := getSucceededOutputs(entry); !reflect.DeepEqual(succeeded, expected) {
+		t.Fatalf("unexpected succeeded outputs %v", succeeded)
+	}
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	webserver "github.com/zhongjie-cai/web-server"
+)
+
+type jobList struct {
+	Jobs []*job `json:"jobs"`
+}
+
+func writeJSONResponse(
+	responseWriter http.ResponseWriter,
+	statusCode int,
+	body interface{},
+) (interface{}, error) {
+	var content, contentError = json.Marshal(body)
+	if contentError != nil {
+		return nil, contentError
+	}
+	responseWriter.Header().Set(
+		"Content-Type",
+		"application/json",
+	)
+	responseWriter.Header().Set(
+		"Content-Length",
+		strconv.Itoa(len(content)),
+	)
+	responseWriter.WriteHeader(statusCode)
+	responseWriter.Write(content)
+	return webserver.SkipResponseHandling()
+}
+
+func getJobFromSession(session webserver.Session) (*job, error) {
+	var counter int
+	var counterError = session.GetRequestParameter(
+		"counter",
+		&counter,
+	)
+	if counterError != nil {
+		return nil, counterError
+	}
+	var job, found = jobs.Get(counter)
+	if !found {
+		return nil, webserver.GetNotFound(
+			fmt.Sprintf("job not found for counter %d", counter),
+		)
+	}
+	job.QueuePosition = queue.positions()[job.Counter]
+	return job, nil
+}
+
+func listJobsWithPositions() []*job {
+	var positions = queue.positions()
+	var all = jobs.List()
+	for _, entry := range all {
+		entry.QueuePosition = positions[entry.Counter]
+	}
+	return all
+}
+
+func listJobsAction(session webserver.Session) (interface{}, error) {
+	return jobList{
+		Jobs: listJobsWithPositions(),
+	}, nil
+}
+
+func getJobAction(session webserver.Session) (interface{}, error) {
+	return getJobFromSession(session)
+}
+
+func getControlledJob(session webserver.Session) (*job, *jobControl, error) {
+	var job, jobError = getJobFromSession(session)
+	if jobError != nil {
+		return nil, nil, jobError
+	}
+	var control, found = controls.get(job.Counter)
+	if job.FinishedAt != nil || !found {
+		return nil, nil, webserver.GetBadRequest(
+			fmt.Sprintf("job %d is already %s", job.Counter, job.State),
+		)
+	}
+	return job, control, nil
+}
+
+func cancelJobAction(session webserver.Session) (interface{}, error) {
+	var controlled, control, jobError = getControlledJob(session)
+	if jobError != nil {
+		return nil, jobError
+	}
+	control.cancel()
+	if queue.remove(controlled.Counter) {
+		controls.remove(controlled.Counter)
+	}
+	var suspended = control.takeSuspended()
+	if suspended != nil {
+		processBatch(*suspended)
+	}
+	return jobs.Update(
+		controlled.Counter,
+		func(job *job) {
+			if job.StartedAt == nil {
+				var finishedAt = time.Now()
+				job.State = JOB_STATE_CANCELED
+				job.FinishedAt = &finishedAt
+			}
+		},
+	)
+}
+
+func pauseJobAction(session webserver.Session) (interface{}, error) {
+	var controlled, control, jobError = getControlledJob(session)
+	if jobError != nil {
+		return nil, jobError
+	}
+	control.pause()
+	return jobs.Update(
+		controlled.Counter,
+		func(job *job) {
+			if job.FinishedAt == nil {
+				job.State = JOB_STATE_PAUSED
+			}
+		},
+	)
+}
+
+func resumeJobAction(session webserver.Session) (interface{}, error) {
+	var controlled, control, jobError = getControlledJob(session)
+	if jobError != nil {
+		return nil, jobError
+	}
+	var suspended = control.resume()
+	if suspended != nil {
+		var pushError = queue.push(*suspended)
+		if pushError != nil {
+			control.pause()
+			control.suspend(*suspended)
+			return writeQueueFullResponse(session)
+		}
+	}
+	return jobs.Update(
+		controlled.Counter,
+		func(job *job) {
+			if job.FinishedAt != nil {
+				return
+			}
+			job.State = JOB_STATE_QUEUED
+			if job.StartedAt != nil && suspended == nil {
+				job.State = JOB_STATE_RUNNING
+			}
+		},
+	)
+}
+
+func getJobOptions(job *job) (reactorOptions, error) {
+	var options = job.Options.clone()
+	options.normalize()
+	if options.SelectSource == 0 {
+		options.sourceImage, _ = loadJobSource(job.Counter)
+	}
+	var validateError = options.validate()
+	if validateError != nil {
+		return reactorOptions{}, fmt.Errorf("options of job %d: %w", job.Counter, validateError)
+	}
+	return options, nil
+}
+
+func retryJobAction(session webserver.Session) (interface{}, error) {
+	var previous, previousError = getJobFromSession(session)
+	if previousError != nil {
+		return nil, previousError
+	}
+	if previous.FinishedAt == nil {
+		return nil, webserver.GetBadRequest(
+			fmt.Sprintf("job %d is still %s", previous.Counter, previous.State),
+		)
+	}
+	var failed = getFailedIndexes(previous)
+	if len(failed) == 0 {
+		return nil, webserver.GetBadRequest(
+			fmt.Sprintf("job %d has no failed images to retry", previous.Counter),
+		)
+	}
+	var inputs, inputsError = loadJobInputs(previous.Counter)
+	if inputsError != nil {
+		return nil, webserver.GetNotFound(
+			fmt.Sprintf("inputs of job %d are no longer retained", previous.Counter),
+			inputsError,
+		)
+	}
+	var targetImageBytes = []imageBytes{}
+	for _, index := range failed {
+		var input, found = inputs[index]
+		if !found {
+			return nil, webserver.GetNotFound(
+				fmt.Sprintf("input %d of job %d is no longer retained", index, previous.Counter),
+			)
+		}
+		targetImageBytes = append(targetImageBytes, input)
+	}
+	var carried = []imageBytes{}
+	if strings.HasSuffix(previous.File, ".cache.zip") {
+		var outputs, outputsError = loadArchivedOutputs(
+			previous.File,
+			getSucceededOutputs(previous),
+		)
+		if outputsError != nil && !errors.Is(outputsError, os.ErrNotExist) {
+			return nil, outputsError
+		}
+		carried = outputs
+	}
+	var imageProcessor, processorError = getProcessor(previous.Processor)
+	if processorError != nil {
+		return nil, processorError
+	}
+	var reactorAPI, reactorAPIError = imageProcessor.Endpoint(previous.ReactorAPI)
+	if reactorAPIError != nil {
+		return nil, reactorAPIError
+	}
+	var options, optionsError = getJobOptions(previous)
+	if optionsError != nil {
+		return nil, webserver.GetInvalidOperation(
+			fmt.Sprintf("job %d can no longer be retried with its original options", previous.Counter),
+			optionsError,
+		)
+	}
+	var submitted, submitError = submitBatches([]item{
+		{
+			imageProcessor:   imageProcessor,
+			targetImageBytes: targetImageBytes,
+			namePrefix:       previous.NamePrefix,
+			reactorAPI:       reactorAPI,
+			quality:          previous.Quality,
+			options:          options,
+			end:              len(targetImageBytes),
+			priority:         previous.Priority,
+			submitter:        getSubmitter(session.GetRequest()),
+			retryOf:          previous.Counter,
+			carried:          carried,
+			session:          session,
+		},
+	})
+	if errors.Is(submitError, errQueueFull) {
+		return writeQueueFullResponse(session)
+	}
+	if errors.Is(submitError, errQuotaExceeded) {
+		return writeQuotaExceededResponse(session, submitError)
+	}
+	if submitError != nil {
+		return nil, submitError
+	}
+	var responseWriter = session.GetResponseWriter()
+	responseWriter.Header().Set(
+		"Location",
+		submitted[0].StatusURL,
+	)
+	return writeJSONResponse(
+		responseWriter,
+		http.StatusAccepted,
+		submittedJobs{
+			Jobs: submitted,
+		},
+	)
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestGetJobOptions(t *testing.T) {
+	useTestStorage(t)
+	appConfig.InputRetention = time.Hour
+	var restored, err = getJobOptions(&job{Counter: 1, Options: defaultReactorOptions.clone()})
+	if err != nil || restored.FaceModel != defaultReactorOptions.FaceModel {
+		t.Fatalf("valid options should be restored, got %+v %v", restored, err)
+	}
+	var invalid = defaultReactorOptions.clone()
+	invalid.FaceModel = "custom.safetensors"
+	invalid.Scale = 0
+	if _, err := getJobOptions(&job{Counter: 2, Options: invalid}); err == nil {
+		t.Fatal("invalid options must not fall back to the defaults")
+	}
+	var withSource = defaultReactorOptions.clone()
+	withSource.SelectSource = 0
+	if _, err := getJobOptions(&job{Counter: 3, Options: withSource}); err == nil {
+		t.Fatal("a source image job without a retained source must fail")
+	}
+	withSource.sourceImage = []byte("source")
+	saveJobSource(3, withSource)
+	restored, err = getJobOptions(&job{Counter: 3, Options: withSource})
+	if err != nil || string(restored.sourceImage) != "source" {
+		t.Fatalf("retained source should be restored, got %v", err)
+	}
+}
+
+func TestGetBatchRanges(t *testing.T) {
+	for _, test := range []struct {
+		count    int
+		batches  int
+		expected [][2]int
+	}{
+		{count: 5, batches: 0, expected: [][2]int{{0, 5}}},
+		{count: 5, batches: 2, expected: [][2]int{{0, 3}, {3, 5}}},
+		{count: 4, batches: 4, expected: [][2]int{{0, 1}, {1, 2}, {2, 3}, {3, 4}}},
+		{count: 2, batches: 5, expected: [][2]int{{0, 1}, {1, 2}}},
+		{count: 0, batches: 2, expected: [][2]int{}},
+	} {
+		if ranges := getBatchRanges(test.count, test.batches); !reflect.DeepEqual(ranges, test.expected) {
+			t.Errorf("getBatchRanges(%d, %d) = %v, want %v", test.count, test.batches, ranges, test.expected)
+		}
+	}
+}
+
+func TestGetSplitBatches(t *testing.T) {
+	for value, expected := range map[string]int{"": 1, "3": 3, "many": 1} {
+		var values = map[string]string{}
+		if value != "" {
+			values["batches"] = value
+		}
+		if batches := getSplitBatches(newTestForm(t, values, nil)); batches != expected {
+			t.Errorf("getSplitBatches(%q) = %d, want %d", value, batches, expected)
+		}
+	}
+}
+
+func getTestJSON(t *testing.T, url string, value interface{}) int {
+	var response, err = http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	json.NewDecoder(response.Body).Decode(value)
+	return response.StatusCode
+}
+
+func TestSubmittedBatchesAreListedWithPositions(t *testing.T) {
+	var address = startTestServer(t, 0, 0)
+	var body bytes.Buffer
+	var form = multipart.NewWriter(&body)
+	form.WriteField("batches", "2")
+	for _, name := range []string{"a.png", "b.png", "c.png"} {
+		var part, _ = form.CreateFormFile("target_image", name)
+		part.Write(getTestPNG(t))
+	}
+	form.Close()
+	var response, err = http.Post(address+"/process", form.FormDataContentType(), &body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var content, _ = io.ReadAll(response.Body)
+	response.Body.Close()
+	var submitted submittedJobs
+	json.Unmarshal(content, &submitted)
+	if response.StatusCode != http.StatusAccepted || len(submitted.Jobs) != 2 {
+		t.Fatalf("expected two accepted batches, got %d %s", response.StatusCode, content)
+	}
+	var first, second = submitted.Jobs[0], submitted.Jobs[1]
+	if first.Start != 0 || first.End != 2 || second.Start != 2 || second.End != 3 || first.Counter == second.Counter {
+		t.Fatalf("unexpected batches %+v", submitted.Jobs)
+	}
+	var listed jobList
+	if status := getTestJSON(t, address+"/jobs", &listed); status != http.StatusOK || len(listed.Jobs) != 2 {
+		t.Fatalf("unexpected job list %d %+v", status, listed)
+	}
+	for position, entry := range submitted.Jobs {
+		var status job
+		if code := getTestJSON(t, address+entry.StatusURL, &status); code != http.StatusOK {
+			t.Fatalf("job %d: unexpected status %d", entry.Counter, code)
+		}
+		if status.Counter != entry.Counter || status.State != JOB_STATE_QUEUED || status.QueuePosition != position+1 {
+			t.Fatalf("unexpected job %+v", status)
+		}
+		if len(status.Images) != entry.End-entry.Start {
+			t.Fatalf("job %d should track %d images, got %d", entry.Counter, entry.End-entry.Start, len(status.Images))
+		}
+	}
+	var missing = second.Counter + 100
+	if code := getTestJSON(t, address+fmt.Sprintf("/jobs/%d", missing), &struct{}{}); code != http.StatusNotFound {
+		t.Fatalf("expected an unknown job to be missing, got %d", code)
+	}
+}
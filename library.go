@@ -0,0 +1,546 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	webserver "github.com/zhongjie-cai/web-server"
+)
+
+const LEGACY_MODEL_LIBRARY_DIR string = "models"
+
+const FACE_MODEL_SOURCES_DIR string = "sources"
+
+const FACE_MODEL_NAME_PARAMETER webserver.ParameterType = `[A-Za-z0-9][A-Za-z0-9_.-]*`
+
+type faceModelEntry struct {
+	Name       string    `json:"name"`
+	File       string    `json:"file"`
+	HasModel   bool      `json:"has_model"`
+	Sources    []string  `json:"sources,omitempty"`
+	SourceDir  string    `json:"source_dir,omitempty"`
+	ReactorAPI string    `json:"reactor_api,omitempty"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+var errFaceModelNotFound = errors.New("face model not found in library")
+
+func getFaceModelDir(name string) string {
+	return getStorageName(appConfig.LibraryDir, name)
+}
+
+func getFaceModelFile(name string) string {
+	return fmt.Sprint(name, ".safetensors")
+}
+
+func getFaceModelSourceDir(entry *faceModelEntry) string {
+	if entry.SourceDir == "" {
+		return getStorageName(getFaceModelDir(entry.Name), FACE_MODEL_SOURCES_DIR)
+	}
+	return getStorageName(getFaceModelDir(entry.Name), entry.SourceDir)
+}
+
+func saveFaceModelEntry(entry *faceModelEntry) error {
+	var content, contentError = json.MarshalIndent(entry, "", "  ")
+	if contentError != nil {
+		return contentError
+	}
+	return outputs.Put(
+		getStorageName(getFaceModelDir(entry.Name), "model.json"),
+		content,
+	)
+}
+
+func getFaceModelEntry(name string) (*faceModelEntry, error) {
+	var content, contentError = outputs.Get(
+		getStorageName(getFaceModelDir(name), "model.json"),
+	)
+	if errors.Is(contentError, os.ErrNotExist) {
+		return nil, fmt.Errorf("%w: %s", errFaceModelNotFound, name)
+	}
+	if contentError != nil {
+		return nil, contentError
+	}
+	var entry faceModelEntry
+	var entryError = json.Unmarshal(content, &entry)
+	if entryError != nil {
+		return nil, entryError
+	}
+	return &entry, nil
+}
+
+func getOrCreateFaceModelEntry(name string) (*faceModelEntry, error) {
+	var entry, entryError = getFaceModelEntry(name)
+	if errors.Is(entryError, errFaceModelNotFound) {
+		return &faceModelEntry{
+			Name:      name,
+			File:      getFaceModelFile(name),
+			CreatedAt: time.Now(),
+		}, nil
+	}
+	return entry, entryError
+}
+
+func getFaceModelSourceNames(faceImageBytes []imageBytes) []string {
+	var names = []string{}
+	var used = map[string]bool{}
+	for index, faceImage := range faceImageBytes {
+		var name = path.Base(filepath.ToSlash(faceImage.name))
+		if used[name] {
+			name = fmt.Sprintf("%04d_%s", index, name)
+		}
+		used[name] = true
+		names = append(names, name)
+	}
+	return names
+}
+
+func deleteFaceModelSources(sourceDir string, sources []string) {
+	for _, source := range sources {
+		outputs.Delete(getStorageName(sourceDir, source))
+	}
+}
+
+func storeFaceModelSources(
+	name string,
+	reactorAPI string,
+	faceImageBytes []imageBytes,
+) (*faceModelEntry, error) {
+	var entry, entryError = getOrCreateFaceModelEntry(name)
+	if entryError != nil {
+		return nil, entryError
+	}
+	var previous = *entry
+	entry.ReactorAPI = reactorAPI
+	entry.SourceDir = fmt.Sprint(FACE_MODEL_SOURCES_DIR, "-", time.Now().UnixNano())
+	entry.Sources = []string{}
+	var sourceDir = getFaceModelSourceDir(entry)
+	for index, sourceName := range getFaceModelSourceNames(faceImageBytes) {
+		var putError = outputs.Put(
+			getStorageName(sourceDir, sourceName),
+			faceImageBytes[index].bytes,
+		)
+		if putError != nil {
+			deleteFaceModelSources(sourceDir, entry.Sources)
+			return nil, putError
+		}
+		entry.Sources = append(entry.Sources, sourceName)
+	}
+	sort.Strings(entry.Sources)
+	var saveError = saveFaceModelEntry(entry)
+	if saveError != nil {
+		deleteFaceModelSources(sourceDir, entry.Sources)
+		return nil, saveError
+	}
+	deleteFaceModelSources(getFaceModelSourceDir(&previous), previous.Sources)
+	return entry, nil
+}
+
+func listFaceModelEntries() ([]*faceModelEntry, error) {
+	var objects, objectsError = outputs.List(appConfig.LibraryDir + "/")
+	if objectsError != nil {
+		return nil, objectsError
+	}
+	var entries = []*faceModelEntry{}
+	for _, object := range objects {
+		var relative = strings.TrimPrefix(object.Name, appConfig.LibraryDir+"/")
+		var name, file, _ = strings.Cut(relative, "/")
+		if file != "model.json" {
+			continue
+		}
+		var entry, entryError = getFaceModelEntry(name)
+		if entryError != nil {
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+func validateSafetensors(content []byte) error {
+	if len(content) < 10 {
+		return errors.New("file is too small to be a safetensors model")
+	}
+	var headerLength = binary.LittleEndian.Uint64(content[:8])
+	if headerLength < 2 || headerLength > uint64(len(content)-8) {
+		return errors.New("file has an invalid safetensors header length")
+	}
+	var header = map[string]json.RawMessage{}
+	var headerError = json.Unmarshal(content[8:8+headerLength], &header)
+	if headerError != nil {
+		return fmt.Errorf("file has an invalid safetensors header: %w", headerError)
+	}
+	return nil
+}
+
+func storeFaceModelFile(name string, content []byte) (*faceModelEntry, error) {
+	var validateError = validateSafetensors(content)
+	if validateError != nil {
+		return nil, validateError
+	}
+	var entry, entryError = getOrCreateFaceModelEntry(name)
+	if entryError != nil {
+		return nil, entryError
+	}
+	var putError = outputs.Put(
+		getStorageName(getFaceModelDir(name), entry.File),
+		content,
+	)
+	if putError != nil {
+		return nil, putError
+	}
+	entry.HasModel = true
+	return entry, saveFaceModelEntry(entry)
+}
+
+func deleteFaceModel(name string) error {
+	var objects, objectsError = outputs.List(getFaceModelDir(name) + "/")
+	if objectsError != nil {
+		return objectsError
+	}
+	for _, object := range objects {
+		var deleteError = outputs.Delete(object.Name)
+		if deleteError != nil {
+			return deleteError
+		}
+	}
+	return nil
+}
+
+func renameFaceModel(name string, newName string) (*faceModelEntry, error) {
+	var entry, entryError = getFaceModelEntry(name)
+	if entryError != nil {
+		return nil, entryError
+	}
+	var _, existingError = getFaceModelEntry(newName)
+	if existingError == nil {
+		return nil, fmt.Errorf("face model %s already exists", newName)
+	}
+	if !errors.Is(existingError, errFaceModelNotFound) {
+		return nil, existingError
+	}
+	var renamed = *entry
+	renamed.Name = newName
+	renamed.File = getFaceModelFile(newName)
+	var copies = map[string]string{}
+	if entry.HasModel {
+		copies[getStorageName(getFaceModelDir(name), entry.File)] = getStorageName(getFaceModelDir(newName), renamed.File)
+	}
+	for _, source := range entry.Sources {
+		copies[getStorageName(getFaceModelSourceDir(entry), source)] = getStorageName(getFaceModelSourceDir(&renamed), source)
+	}
+	for from, to := range copies {
+		var content, contentError = outputs.Get(from)
+		if contentError == nil {
+			contentError = outputs.Put(to, content)
+		}
+		if contentError != nil {
+			deleteFaceModel(newName)
+			return nil, contentError
+		}
+	}
+	var saveError = saveFaceModelEntry(&renamed)
+	if saveError != nil {
+		deleteFaceModel(newName)
+		return nil, saveError
+	}
+	return &renamed, deleteFaceModel(name)
+}
+
+func loadFaceModelSources(entry *faceModelEntry) ([]imageBytes, error) {
+	var sources = []imageBytes{}
+	for _, source := range entry.Sources {
+		var content, contentError = outputs.Get(
+			getStorageName(getFaceModelSourceDir(entry), source),
+		)
+		if contentError != nil {
+			return nil, contentError
+		}
+		sources = append(sources, imageBytes{
+			bytes: content,
+			name:  source,
+		})
+	}
+	return sources, nil
+}
+
+func getFaceModelDownload(entry *faceModelEntry) (*imageBytes, error) {
+	if entry.HasModel {
+		var content, contentError = outputs.Get(
+			getStorageName(getFaceModelDir(entry.Name), entry.File),
+		)
+		if contentError != nil {
+			return nil, contentError
+		}
+		return &imageBytes{
+			bytes: content,
+			name:  entry.File,
+		}, nil
+	}
+	var sources, sourcesError = loadFaceModelSources(entry)
+	if sourcesError != nil {
+		return nil, sourcesError
+	}
+	var buffer bytes.Buffer
+	var zipper = zip.NewWriter(&buffer)
+	for _, source := range sources {
+		var writer, writerError = zipper.Create(source.name)
+		if writerError != nil {
+			return nil, writerError
+		}
+		writer.Write(source.bytes)
+	}
+	var closeError = zipper.Close()
+	if closeError != nil {
+		return nil, closeError
+	}
+	return &imageBytes{
+		bytes: buffer.Bytes(),
+		name:  fmt.Sprint(entry.Name, ".sources.zip"),
+	}, nil
+}
+
+type faceModelEntryList struct {
+	Models []*faceModelEntry `json:"models"`
+}
+
+type faceModelRename struct {
+	Name string `json:"name"`
+}
+
+func getLibraryEntryFromSession(session webserver.Session) (*faceModelEntry, error) {
+	var name string
+	var nameError = session.GetRequestParameter(
+		"name",
+		&name,
+	)
+	if nameError != nil {
+		return nil, nameError
+	}
+	var entry, entryError = getFaceModelEntry(name)
+	if errors.Is(entryError, errFaceModelNotFound) {
+		return nil, webserver.GetNotFound(entryError.Error())
+	}
+	return entry, entryError
+}
+
+func listLibraryAction(session webserver.Session) (interface{}, error) {
+	var entries, entriesError = listFaceModelEntries()
+	if entriesError != nil {
+		return nil, entriesError
+	}
+	return faceModelEntryList{
+		Models: entries,
+	}, nil
+}
+
+func getLibraryAction(session webserver.Session) (interface{}, error) {
+	return getLibraryEntryFromSession(session)
+}
+
+func uploadLibraryAction(session webserver.Session) (interface{}, error) {
+	var request = session.GetRequest()
+	var parseErr = request.ParseMultipartForm(int64(appConfig.MultipartMemory))
+	if parseErr != nil {
+		return nil, webserver.GetBadRequest("expecting a multipart upload", parseErr)
+	}
+	var modelBytes, modelErr = getImageBytes(
+		request.MultipartForm,
+		"model",
+	)
+	if modelErr != nil {
+		return nil, modelErr
+	}
+	if len(modelBytes) != 1 {
+		return nil, webserver.GetBadRequest("expecting exactly one model file")
+	}
+	if _, found := getFormValue(request.MultipartForm, "model_name"); !found {
+		request.MultipartForm.Value["model_name"] = []string{
+			strings.TrimSuffix(filepath.Base(modelBytes[0].name), ".safetensors"),
+		}
+	}
+	var name, nameErr = getFaceModelName(request.MultipartForm)
+	if nameErr != nil {
+		return nil, nameErr
+	}
+	var entry, entryErr = storeFaceModelFile(name, modelBytes[0].bytes)
+	if entryErr != nil {
+		return nil, webserver.GetBadRequest(
+			fmt.Sprintf("unable to store face model %s", name),
+			entryErr,
+		)
+	}
+	return entry, nil
+}
+
+func renameLibraryAction(session webserver.Session) (interface{}, error) {
+	var entry, entryError = getLibraryEntryFromSession(session)
+	if entryError != nil {
+		return nil, entryError
+	}
+	var rename faceModelRename
+	var renameError = session.GetRequestBody(&rename)
+	if renameError != nil {
+		return nil, renameError
+	}
+	var newName = strings.TrimSuffix(rename.Name, ".safetensors")
+	if !faceModelNamePattern.MatchString(newName) {
+		return nil, webserver.GetBadRequest(
+			fmt.Sprintf("invalid name %q, use letters, digits, dot, dash and underscore only", rename.Name),
+		)
+	}
+	var renamed, renamedError = renameFaceModel(entry.Name, newName)
+	if renamedError != nil {
+		return nil, webserver.GetBadRequest(
+			fmt.Sprintf("unable to rename face model %s", entry.Name),
+			renamedError,
+		)
+	}
+	return renamed, nil
+}
+
+func deleteLibraryAction(session webserver.Session) (interface{}, error) {
+	var entry, entryError = getLibraryEntryFromSession(session)
+	if entryError != nil {
+		return nil, entryError
+	}
+	return nil, deleteFaceModel(entry.Name)
+}
+
+func downloadLibraryAction(session webserver.Session) (interface{}, error) {
+	var entry, entryError = getLibraryEntryFromSession(session)
+	if entryError != nil {
+		return nil, entryError
+	}
+	var download, downloadError = getFaceModelDownload(entry)
+	if downloadError != nil {
+		return nil, downloadError
+	}
+	var responseWriter = session.GetResponseWriter()
+	responseWriter.Header().Set(
+		"Content-Type",
+		"application/octet-stream",
+	)
+	responseWriter.Header().Set(
+		"Content-Length",
+		strconv.Itoa(len(download.bytes)),
+	)
+	responseWriter.Header().Set(
+		"Content-Disposition",
+		fmt.Sprint("attachment;filename=", download.name),
+	)
+	responseWriter.WriteHeader(http.StatusOK)
+	responseWriter.Write(download.bytes)
+	return webserver.SkipResponseHandling()
+}
+
+func copyFaceModelFile(entry *faceModelEntry) (*faceModelReference, error) {
+	var content, contentError = outputs.Get(
+		getStorageName(getFaceModelDir(entry.Name), entry.File),
+	)
+	if contentError != nil {
+		return nil, contentError
+	}
+	var target = filepath.Join(appConfig.ReactorFacesDir, entry.File)
+	var tempName = target + ".tmp"
+	var writeError = os.WriteFile(tempName, content, 0644)
+	if writeError != nil {
+		return nil, writeError
+	}
+	var renameError = os.Rename(tempName, target)
+	if renameError != nil {
+		return nil, renameError
+	}
+	return &faceModelReference{
+		Name:    entry.Name,
+		File:    entry.File,
+		Copied:  target,
+		Library: entry,
+	}, nil
+}
+
+func pushLibraryAction(session webserver.Session) (interface{}, error) {
+	var entry, entryError = getLibraryEntryFromSession(session)
+	if entryError != nil {
+		return nil, entryError
+	}
+	if entry.HasModel && appConfig.ReactorFacesDir != "" {
+		var faceModel, faceModelErr = copyFaceModelFile(entry)
+		if faceModelErr != nil {
+			return nil, webserver.GetGeneralFailure(
+				fmt.Sprintf("unable to copy face model %s into %s", entry.Name, appConfig.ReactorFacesDir),
+				faceModelErr,
+			)
+		}
+		return faceModel, nil
+	}
+	if len(entry.Sources) == 0 {
+		return nil, webserver.GetInvalidOperation(
+			fmt.Sprintf(
+				"face model %s has no source images to rebuild it from; set reactor_faces_dir to push it as a file",
+				entry.Name,
+			),
+		)
+	}
+	var reactorAPI, reactorAPIError = getFaceModelsAPI(
+		session.GetRequest().URL.Query().Get("reactor_api"),
+	)
+	if reactorAPIError != nil {
+		return nil, reactorAPIError
+	}
+	var sources, sourcesError = loadFaceModelSources(entry)
+	if sourcesError != nil {
+		return nil, sourcesError
+	}
+	var faceModel, faceModelErr = generateFaceModel(session.GetRequest().Context(), sources, reactorAPI, entry.Name)
+	if faceModelErr != nil {
+		return nil, webserver.GetGeneralFailure(
+			fmt.Sprintf("unable to push face model %s", entry.Name),
+			faceModelErr,
+		)
+	}
+	return faceModel, nil
+}
+
+func migrateLegacyFaceModelLibrary() error {
+	var walkError = filepath.WalkDir(
+		LEGACY_MODEL_LIBRARY_DIR,
+		func(filename string, entry fs.DirEntry, err error) error {
+			if err != nil || entry.IsDir() {
+				return err
+			}
+			var relative, relativeError = filepath.Rel(LEGACY_MODEL_LIBRARY_DIR, filename)
+			if relativeError != nil {
+				return relativeError
+			}
+			var content, contentError = os.ReadFile(filename)
+			if contentError != nil {
+				return contentError
+			}
+			return outputs.Put(
+				getStorageName(appConfig.LibraryDir, filepath.ToSlash(relative)),
+				content,
+			)
+		},
+	)
+	if errors.Is(walkError, os.ErrNotExist) {
+		return nil
+	}
+	if walkError != nil {
+		return walkError
+	}
+	return os.RemoveAll(LEGACY_MODEL_LIBRARY_DIR)
+}
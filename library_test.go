@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestStoreFaceModelSourcesKeepsStoredNames(t *testing.T) {
+	useTestStorage(t)
+	var entry, err = storeFaceModelSources(
+		"alice",
+		"http://backend/reactor/facemodels",
+		[]imageBytes{{name: "dir/a.png", bytes: []byte("a")}, {name: "b.png", bytes: []byte("b")}},
+	)
+	if err != nil || !reflect.DeepEqual(entry.Sources, []string{"a.png", "b.png"}) {
+		t.Fatalf("unexpected sources %v %v", entry, err)
+	}
+	var sources, sourcesErr = loadFaceModelSources(entry)
+	if sourcesErr != nil {
+		t.Fatal(sourcesErr)
+	}
+	var restored, restoredErr = storeFaceModelSources("alice", entry.ReactorAPI, sources)
+	if restoredErr != nil || !reflect.DeepEqual(restored.Sources, entry.Sources) {
+		t.Fatalf("re-storing should keep the names, got %v %v", restored, restoredErr)
+	}
+	var reloaded, _ = loadFaceModelSources(restored)
+	if len(reloaded) != 2 || string(reloaded[1].bytes) != "b" {
+		t.Fatalf("unexpected reloaded sources %v", reloaded)
+	}
+	var objects, _ = outputs.List(getFaceModelDir("alice") + "/")
+	if len(objects) != 3 {
+		t.Fatalf("old source set should be removed, got %v", objects)
+	}
+}
+
+func TestStoreFaceModelSourcesDisambiguatesDuplicates(t *testing.T) {
+	var names = getFaceModelSourceNames([]imageBytes{{name: "x/a.png"}, {name: "y/a.png"}})
+	if !reflect.DeepEqual(names, []string{"a.png", "0001_a.png"}) {
+		t.Fatalf("unexpected names %v", names)
+	}
+}
+
+func TestStoreFaceModelSourcesKeepsOldSetOnFailure(t *testing.T) {
+	useTestStorage(t)
+	var entry, _ = storeFaceModelSources("alice", "", []imageBytes{{name: "a.png", bytes: []byte("a")}})
+	var store = outputs
+	outputs = failingPutStorage{store}
+	if _, err := storeFaceModelSources("alice", "", []imageBytes{{name: "b.png", bytes: []byte("b")}}); err == nil {
+		t.Fatal("expected the failed put to be reported")
+	}
+	outputs = store
+	var current, _ = getFaceModelEntry("alice")
+	var sources, err = loadFaceModelSources(current)
+	if err != nil || !reflect.DeepEqual(current.Sources, entry.Sources) || string(sources[0].bytes) != "a" {
+		t.Fatalf("old sources should survive, got %v %v %v", current, sources, err)
+	}
+}
+
+func TestRenameFaceModelMovesEverything(t *testing.T) {
+	useTestStorage(t)
+	storeFaceModelSources("alice", "", []imageBytes{{name: "a.png", bytes: []byte("a")}})
+	storeFaceModelFile("alice", getFakeFaceModel("alice", 1))
+	storeFaceModelSources("bob", "", []imageBytes{{name: "b.png", bytes: []byte("b")}})
+	if _, err := renameFaceModel("alice", "bob"); err == nil {
+		t.Fatal("renaming onto an existing model should fail")
+	}
+	var renamed, err = renameFaceModel("alice", "carol")
+	if err != nil || renamed.File != "carol.safetensors" || !renamed.HasModel {
+		t.Fatalf("unexpected rename %v %v", renamed, err)
+	}
+	if _, err := getFaceModelEntry("alice"); err == nil {
+		t.Fatal("old entry should be gone")
+	}
+	var download, _ = getFaceModelDownload(renamed)
+	var sources, _ = loadFaceModelSources(renamed)
+	if download == nil || download.name != "carol.safetensors" || len(sources) != 1 {
+		t.Fatalf("renamed model is incomplete: %v %v", download, sources)
+	}
+	var entries, _ = listFaceModelEntries()
+	if len(entries) != 2 || entries[0].Name != "bob" || entries[1].Name != "carol" {
+		t.Fatalf("unexpected library %v", entries)
+	}
+}
+
+func TestMigrateLegacyFaceModelLibrary(t *testing.T) {
+	useTestStorage(t)
+	var workingDir, _ = os.Getwd()
+	os.Chdir(t.TempDir())
+	t.Cleanup(func() {
+		os.Chdir(workingDir)
+	})
+	var entry, _ = json.Marshal(faceModelEntry{Name: "alice", File: "alice.safetensors", Sources: []string{"0000_a.png"}})
+	os.MkdirAll(filepath.Join(LEGACY_MODEL_LIBRARY_DIR, "alice", "sources"), 0755)
+	os.WriteFile(filepath.Join(LEGACY_MODEL_LIBRARY_DIR, "alice", "model.json"), entry, 0644)
+	os.WriteFile(filepath.Join(LEGACY_MODEL_LIBRARY_DIR, "alice", "sources", "0000_a.png"), []byte("a"), 0644)
+	if err := migrateLegacyFaceModelLibrary(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(LEGACY_MODEL_LIBRARY_DIR); !os.IsNotExist(err) {
+		t.Fatal("legacy library should be removed")
+	}
+	var migrated, err = getFaceModelEntry("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sources, sourcesErr = loadFaceModelSources(migrated)
+	if sourcesErr != nil || string(sources[0].bytes) != "a" {
+		t.Fatalf("unexpected migrated sources %v %v", sources, sourcesErr)
+	}
+}
+
+func TestUploadLibraryWithoutFacesDir(t *testing.T) {
+	var address = startTestServer(t, 0, 0)
+	appConfig.ReactorFacesDir = ""
+	var body bytes.Buffer
+	var form = multipart.NewWriter(&body)
+	var part, _ = form.CreateFormFile("model", "dave.safetensors")
+	part.Write(getFakeFaceModel("dave", 1))
+	form.Close()
+	var response, err = http.Post(address+"/library", form.FormDataContentType(), &body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		t.Fatalf("upload: %d", response.StatusCode)
+	}
+	var entry, entryErr = getFaceModelEntry("dave")
+	if entryErr != nil || !entry.HasModel {
+		t.Fatalf("unexpected entry %v %v", entry, entryErr)
+	}
+	var pushed, _ = http.Post(address+"/library/dave/push", "application/json", nil)
+	pushed.Body.Close()
+	if pushed.StatusCode == http.StatusOK {
+		t.Fatal("push without a faces dir or sources should be refused")
+	}
+}
@@ -1,18 +1,37 @@
 package main
 
 import (
+	"fmt"
+	"os"
+
 	webserver "github.com/zhongjie-cai/web-server"
 )
 
 const APP_VERSION string = `1.1.1`
 
+var appSession webserver.SessionLogging
+
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "fake-reactor" {
+		var fakeErr = runFakeReactor(os.Args[2:])
+		if fakeErr != nil {
+			fmt.Println(fakeErr)
+			os.Exit(1)
+		}
+		return
+	}
+	var configErr = loadConfig(os.Args[1:])
+	if configErr != nil {
+		fmt.Println(configErr)
+		os.Exit(2)
+	}
 	var application = webserver.NewApplication(
 		"ImageProcessor",
-		":8080",
+		appConfig.ListenAddress,
 		APP_VERSION,
 		&myCustomization{},
 	)
+	appSession = application.Session()
 	defer application.Stop()
 	application.Start()
 }
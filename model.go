@@ -2,12 +2,16 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"mime/multipart"
 	"net/http"
 	"os"
-	"strconv"
+	"path/filepath"
+	"regexp"
+	"strings"
 
 	webserver "github.com/zhongjie-cai/web-server"
 )
@@ -18,10 +22,61 @@ type faceModelRequest struct {
 	ComputeMethod int      `json:"compute_method"`
 }
 
+type faceModelResponse struct {
+	FaceModel string `json:"facemodel"`
+}
+
+type faceModelReference struct {
+	Name       string          `json:"name"`
+	File       string          `json:"file"`
+	ReactorAPI string          `json:"reactor_api,omitempty"`
+	Reactor    string          `json:"reactor_response,omitempty"`
+	Copied     string          `json:"copied_to,omitempty"`
+	Note       string          `json:"note,omitempty"`
+	Library    *faceModelEntry `json:"library"`
+}
+
+type faceModelListResponse struct {
+	FaceModels []string `json:"facemodels"`
+}
+
+const DEFAULT_FACE_MODELS_API string = "http://localhost:7860/reactor/facemodels"
+
+const DEFAULT_FACE_MODEL_NAME string = "origin"
+
+const FACE_MODEL_NOT_KEPT_NOTE string = "the ReActor API does not return the built model file; set reactor_faces_dir to the backend's models/reactor/faces directory to keep a copy in the library"
+
+var faceModelNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]{0,63}$`)
+
+func getFaceModelName(multipartForm *multipart.Form) (string, error) {
+	var name, found = getFormValue(multipartForm, "model_name")
+	if !found {
+		return DEFAULT_FACE_MODEL_NAME, nil
+	}
+	name = strings.TrimSuffix(name, ".safetensors")
+	if !faceModelNamePattern.MatchString(name) {
+		return "", webserver.GetBadRequest(
+			fmt.Sprintf("invalid model_name %q, use letters, digits, dot, dash and underscore only", name),
+		)
+	}
+	return name, nil
+}
+
+func normalizeFaceModel(faceModel string) string {
+	if faceModel == "" ||
+		strings.EqualFold(faceModel, "None") ||
+		strings.HasSuffix(faceModel, ".safetensors") {
+		return faceModel
+	}
+	return faceModel + ".safetensors"
+}
+
 func generateFaceModel(
+	ctx context.Context,
 	faceImageBytes []imageBytes,
 	reactorAPI string,
-) (*imageBytes, error) {
+	modelName string,
+) (*faceModelReference, error) {
 	var faceImages = make([]string, 0)
 	for _, faceImageItem := range faceImageBytes {
 		var faceImage = IMAGE_PREFIX + base64.StdEncoding.EncodeToString(
@@ -32,7 +87,7 @@ func generateFaceModel(
 	var content, contentError = json.Marshal(
 		faceModelRequest{
 			SourceImages:  faceImages,
-			Name:          "origin",
+			Name:          modelName,
 			ComputeMethod: 0,
 		},
 	)
@@ -40,7 +95,10 @@ func generateFaceModel(
 		return nil, contentError
 	}
 	var body = bytes.NewReader(content)
-	var request, requestError = http.NewRequest(
+	var requestCtx, cancelRequest = getImageContext(ctx)
+	defer cancelRequest()
+	var request, requestError = http.NewRequestWithContext(
+		requestCtx,
 		http.MethodPost,
 		reactorAPI,
 		body,
@@ -52,15 +110,100 @@ func generateFaceModel(
 	if responseError != nil {
 		return nil, responseError
 	}
+	defer response.Body.Close()
 	if response.StatusCode != http.StatusOK {
 		return nil, fmt.Errorf("wrong response [%d]: {%s}", response.StatusCode, response.Status)
 	}
-	return nil, nil
+	var built faceModelResponse
+	var builtError = json.NewDecoder(response.Body).Decode(&built)
+	if builtError != nil {
+		return nil, fmt.Errorf("unexpected reactor response: %w", builtError)
+	}
+	var entry, entryError = storeFaceModelSources(
+		modelName,
+		reactorAPI,
+		faceImageBytes,
+	)
+	if entryError != nil {
+		return nil, entryError
+	}
+	var reference = &faceModelReference{
+		Name:       modelName,
+		File:       getFaceModelFile(modelName),
+		ReactorAPI: reactorAPI,
+		Reactor:    built.FaceModel,
+		Library:    entry,
+	}
+	if appConfig.ReactorFacesDir == "" {
+		reference.Note = FACE_MODEL_NOT_KEPT_NOTE
+		return reference, nil
+	}
+	var modelBytes, modelBytesError = os.ReadFile(
+		filepath.Join(appConfig.ReactorFacesDir, getFaceModelFile(modelName)),
+	)
+	if modelBytesError != nil {
+		return nil, fmt.Errorf("unable to read the built model from reactor_faces_dir: %w", modelBytesError)
+	}
+	reference.Library, entryError = storeFaceModelFile(modelName, modelBytes)
+	if entryError != nil {
+		return nil, fmt.Errorf("reactor wrote an invalid model: %w", entryError)
+	}
+	return reference, nil
+}
+
+func listFaceModels(ctx context.Context, reactorAPI string) ([]string, error) {
+	var requestCtx, cancelRequest = getImageContext(ctx)
+	defer cancelRequest()
+	var request, requestError = http.NewRequestWithContext(
+		requestCtx,
+		http.MethodGet,
+		reactorAPI,
+		nil,
+	)
+	if requestError != nil {
+		return nil, requestError
+	}
+	var response, responseError = http.DefaultClient.Do(request)
+	if responseError != nil {
+		return nil, responseError
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("wrong response [%d]: {%s}", response.StatusCode, response.Status)
+	}
+	var listing faceModelListResponse
+	var listingError = json.NewDecoder(response.Body).Decode(&listing)
+	if listingError != nil {
+		return nil, listingError
+	}
+	var names = []string{}
+	for _, name := range listing.FaceModels {
+		if name != "" && !strings.EqualFold(name, "None") {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+func listModelsAction(session webserver.Session) (interface{}, error) {
+	var reactorAPI, reactorAPIErr = getFaceModelsAPI(
+		session.GetRequest().URL.Query().Get("reactor_api"),
+	)
+	if reactorAPIErr != nil {
+		return nil, reactorAPIErr
+	}
+	var names, namesErr = listFaceModels(session.GetRequest().Context(), reactorAPI)
+	if namesErr != nil {
+		return nil, webserver.GetGeneralFailure("unable to list face models from reactor", namesErr)
+	}
+	return faceModelListResponse{
+		FaceModels: names,
+	}, nil
 }
 
 func modelAction(session webserver.Session) (interface{}, error) {
 	var request = session.GetRequest()
-	var parseErr = request.ParseMultipartForm(2097152)
+	var parseErr = request.ParseMultipartForm(int64(appConfig.MultipartMemory))
 	if parseErr != nil {
 		return nil, parseErr
 	}
@@ -83,25 +226,21 @@ func modelAction(session webserver.Session) (interface{}, error) {
 			},
 		}
 	}
-	var reactorAPI = getReactorAPI(request.MultipartForm)
-	var faceModelBytes, faceModelErr = generateFaceModel(faceImageBytes, reactorAPI)
+	var requestedAPI, _ = getFormValue(request.MultipartForm, "reactor_api")
+	var reactorAPI, reactorAPIErr = getFaceModelsAPI(requestedAPI)
+	if reactorAPIErr != nil {
+		return nil, reactorAPIErr
+	}
+	var modelName, modelNameErr = getFaceModelName(request.MultipartForm)
+	if modelNameErr != nil {
+		return nil, modelNameErr
+	}
+	var faceModel, faceModelErr = generateFaceModel(request.Context(), faceImageBytes, reactorAPI, modelName)
 	if faceModelErr != nil {
-		return nil, faceModelErr
+		return nil, webserver.GetGeneralFailure(
+			fmt.Sprintf("unable to build face model %s", modelName),
+			faceModelErr,
+		)
 	}
-	var responseWriter = session.GetResponseWriter()
-	responseWriter.Header().Set(
-		"Content-Type",
-		"application/octet-stream",
-	)
-	responseWriter.Header().Set(
-		"Content-Length",
-		strconv.Itoa(len(faceModelBytes.bytes)),
-	)
-	responseWriter.Header().Set(
-		"Content-Disposition",
-		fmt.Sprint("attachment;filename=", faceModelBytes.name),
-	)
-	responseWriter.WriteHeader(http.StatusOK)
-	responseWriter.Write(faceModelBytes.bytes)
-	return webserver.SkipResponseHandling()
+	return faceModel, nil
 }
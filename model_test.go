@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func startFakeFaceModels(t *testing.T, facesDir string) string {
+	var reactor = newFakeReactor(0, 0, http.StatusServiceUnavailable)
+	reactor.facesDir = facesDir
+	var server = httptest.NewServer(reactor.handler())
+	t.Cleanup(server.Close)
+	return server.URL + "/reactor/facemodels"
+}
+
+func TestGenerateFaceModelWithoutFacesDir(t *testing.T) {
+	useTestStorage(t)
+	var reactorAPI = startFakeFaceModels(t, "")
+	var reference, err = generateFaceModel(
+		context.Background(),
+		[]imageBytes{{name: "a.png", bytes: getTestPNG(t)}},
+		reactorAPI,
+		"alice",
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reference.Note != FACE_MODEL_NOT_KEPT_NOTE || reference.Library.HasModel || len(reference.Library.Sources) != 1 {
+		t.Fatalf("unexpected reference %+v %+v", reference, reference.Library)
+	}
+}
+
+func TestGenerateFaceModelKeepsTheWrittenModel(t *testing.T) {
+	useTestStorage(t)
+	var facesDir = t.TempDir()
+	appConfig.ReactorFacesDir = facesDir
+	var reactorAPI = startFakeFaceModels(t, facesDir)
+	var reference, err = generateFaceModel(
+		context.Background(),
+		[]imageBytes{{name: "a.png", bytes: getTestPNG(t)}},
+		reactorAPI,
+		"alice",
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reference.Note != "" || !reference.Library.HasModel {
+		t.Fatalf("model file should be kept, got %+v %+v", reference, reference.Library)
+	}
+	var download, downloadErr = getFaceModelDownload(reference.Library)
+	var written, _ = os.ReadFile(filepath.Join(facesDir, "alice.safetensors"))
+	if downloadErr != nil || string(download.bytes) != string(written) {
+		t.Fatalf("library copy differs from the backend file: %v", downloadErr)
+	}
+}
+
+func TestFaceModelRequestsHonourTheContext(t *testing.T) {
+	useTestStorage(t)
+	var reactorAPI = startFakeFaceModels(t, "")
+	var ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	if _, err := listFaceModels(ctx, reactorAPI); err == nil {
+		t.Fatal("listing with a canceled context should fail")
+	}
+	var names, err = listFaceModels(context.Background(), reactorAPI)
+	if err != nil || len(names) == 0 {
+		t.Fatalf("unexpected face models %v %v", names, err)
+	}
+	if _, err := generateFaceModel(ctx, []imageBytes{{name: "a.png", bytes: getTestPNG(t)}}, reactorAPI, "bob"); err == nil {
+		t.Fatal("building with a canceled context should fail")
+	}
+}
+
+func TestNormalizeFaceModel(t *testing.T) {
+	for input, expected := range map[string]string{
+		"":                  "",
+		"None":              "None",
+		"alice":             "alice.safetensors",
+		"alice.safetensors": "alice.safetensors",
+	} {
+		if actual := normalizeFaceModel(input); actual != expected {
+			t.Errorf("normalizeFaceModel(%q) = %q, want %q", input, actual, expected)
+		}
+	}
+}
+
+func TestGetFaceModelName(t *testing.T) {
+	if name, err := getFaceModelName(newTestForm(t, nil, nil)); err != nil || name != DEFAULT_FACE_MODEL_NAME {
+		t.Fatalf("expected the default name, got %q %v", name, err)
+	}
+	if name, err := getFaceModelName(newTestForm(t, map[string]string{"model_name": "alice.safetensors"}, nil)); err != nil || name != "alice" {
+		t.Fatalf("expected the extension to be dropped, got %q %v", name, err)
+	}
+	for _, invalid := range []string{"../alice", "a/b", ".hidden", "alice bob"} {
+		if _, err := getFaceModelName(newTestForm(t, map[string]string{"model_name": invalid}, nil)); err == nil {
+			t.Errorf("expected %q to be refused", invalid)
+		}
+	}
+}
+
+func TestListFaceModelsDropsPlaceholders(t *testing.T) {
+	var server = httptest.NewServer(http.HandlerFunc(func(responseWriter http.ResponseWriter, request *http.Request) {
+		writeFakeResponse(responseWriter, http.StatusOK, faceModelListResponse{
+			FaceModels: []string{"None", "", "alice.safetensors", "bob.safetensors"},
+		})
+	}))
+	t.Cleanup(server.Close)
+	var names, err = listFaceModels(context.Background(), server.URL)
+	if err != nil || !reflect.DeepEqual(names, []string{"alice.safetensors", "bob.safetensors"}) {
+		t.Fatalf("unexpected face models %v %v", names, err)
+	}
+	var failing = httptest.NewServer(http.HandlerFunc(func(responseWriter http.ResponseWriter, request *http.Request) {
+		writeFakeResponse(responseWriter, http.StatusInternalServerError, nil)
+	}))
+	t.Cleanup(failing.Close)
+	if _, err := listFaceModels(context.Background(), failing.URL); err == nil {
+		t.Fatal("expected a failing backend to be reported")
+	}
+}
@@ -0,0 +1,404 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"mime/multipart"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	webserver "github.com/zhongjie-cai/web-server"
+)
+
+type reactorOptions struct {
+	FaceRestorer       string  `json:"face_restorer"`
+	RestorerVisibility float64 `json:"restorer_visibility"`
+	CodeFormerWeight   float64 `json:"codeformer_weight"`
+	Device             string  `json:"device"`
+	Upscaler           string  `json:"upscaler"`
+	Scale              float64 `json:"scale"`
+	UpscaleVisibility  float64 `json:"upscale_visibility"`
+	SourceFacesIndex   []int   `json:"source_faces_index"`
+	FacesIndex         []int   `json:"face_index"`
+	GenderSource       int     `json:"gender_source"`
+	GenderTarget       int     `json:"gender_target"`
+	MaskFace           int     `json:"mask_face"`
+	SelectSource       int     `json:"select_source"`
+	FaceModel          string  `json:"face_model"`
+	sourceImage        []byte
+}
+
+const DEFAULT_PRESET string = "default"
+
+var defaultReactorOptions = reactorOptions{
+	FaceRestorer:       "CodeFormer",
+	RestorerVisibility: 1,
+	CodeFormerWeight:   0.5,
+	Device:             "CUDA",
+	Upscaler:           "None",
+	Scale:              1,
+	UpscaleVisibility:  1,
+	SourceFacesIndex:   []int{0},
+	FacesIndex:         []int{0},
+	GenderSource:       1,
+	GenderTarget:       1,
+	MaskFace:           1,
+	SelectSource:       1,
+	FaceModel:          "origin.safetensors",
+}
+
+var reactorPresets = map[string]json.RawMessage{
+	DEFAULT_PRESET: json.RawMessage(`{}`),
+	"fast": json.RawMessage(`{
+		"face_restorer": "None",
+		"mask_face": 0
+	}`),
+	"quality": json.RawMessage(`{
+		"codeformer_weight": 0.7,
+		"upscaler": "R-ESRGAN 4x+",
+		"scale": 2
+	}`),
+	"cpu": json.RawMessage(`{
+		"device": "CPU"
+	}`),
+}
+
+func (options reactorOptions) clone() reactorOptions {
+	options.SourceFacesIndex = append([]int(nil), options.SourceFacesIndex...)
+	options.FacesIndex = append([]int(nil), options.FacesIndex...)
+	return options
+}
+
+func loadPresetsFile(path string) error {
+	if path == "" {
+		return nil
+	}
+	var fileBytes, fileBytesError = os.ReadFile(path)
+	if fileBytesError != nil {
+		return fileBytesError
+	}
+	var presets map[string]json.RawMessage
+	var presetsError = json.Unmarshal(fileBytes, &presets)
+	if presetsError != nil {
+		return fmt.Errorf("invalid presets file %s: %w", path, presetsError)
+	}
+	for name, preset := range presets {
+		var options, optionsError = applyPreset(defaultReactorOptions, preset)
+		if optionsError != nil {
+			return fmt.Errorf("invalid preset %s: %w", name, optionsError)
+		}
+		options.normalize()
+		var validateError = options.validate()
+		if validateError != nil {
+			return fmt.Errorf("invalid preset %s: %w", name, validateError)
+		}
+		reactorPresets[name] = preset
+	}
+	return nil
+}
+
+func applyPreset(base reactorOptions, preset json.RawMessage) (reactorOptions, error) {
+	var options = base.clone()
+	var presetError = json.Unmarshal(preset, &options)
+	options.normalize()
+	return options, presetError
+}
+
+func getPresetNames() []string {
+	var names = make([]string, 0, len(reactorPresets))
+	for name := range reactorPresets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func getPresetOptions(name string) (reactorOptions, error) {
+	var preset, found = reactorPresets[name]
+	if !found {
+		return reactorOptions{}, fmt.Errorf(
+			"unknown preset %q, expecting one of %s",
+			name,
+			strings.Join(getPresetNames(), ", "),
+		)
+	}
+	return applyPreset(defaultReactorOptions, preset)
+}
+
+var faceRestorers = []string{"None", "CodeFormer", "GFPGAN"}
+
+var reactorDevices = []string{"CPU", "CUDA"}
+
+func normalizeOneOf(value *string, allowed ...string) {
+	for _, candidate := range allowed {
+		if strings.EqualFold(strings.TrimSpace(*value), candidate) {
+			*value = candidate
+			return
+		}
+	}
+}
+
+func isOneOf(value string, allowed ...string) bool {
+	for _, candidate := range allowed {
+		if value == candidate {
+			return true
+		}
+	}
+	return false
+}
+
+func (options *reactorOptions) normalize() {
+	normalizeOneOf(&options.FaceRestorer, faceRestorers...)
+	normalizeOneOf(&options.Device, reactorDevices...)
+}
+
+func (options reactorOptions) validate() error {
+	var problems = []string{}
+	if !isOneOf(options.FaceRestorer, faceRestorers...) {
+		problems = append(problems, "face_restorer must be None, CodeFormer or GFPGAN")
+	}
+	if !isOneOf(options.Device, reactorDevices...) {
+		problems = append(problems, "device must be CPU or CUDA")
+	}
+	if options.Upscaler == "" {
+		problems = append(problems, "upscaler must not be empty, use None to disable")
+	}
+	if options.RestorerVisibility < 0 || options.RestorerVisibility > 1 {
+		problems = append(problems, "restorer_visibility must be between 0 and 1")
+	}
+	if options.CodeFormerWeight < 0 || options.CodeFormerWeight > 1 {
+		problems = append(problems, "codeformer_weight must be between 0 and 1")
+	}
+	if options.UpscaleVisibility < 0 || options.UpscaleVisibility > 1 {
+		problems = append(problems, "upscale_visibility must be between 0 and 1")
+	}
+	if options.Scale < 1 || options.Scale > 8 {
+		problems = append(problems, "scale must be between 1 and 8")
+	}
+	if options.GenderSource < 0 || options.GenderSource > 2 {
+		problems = append(problems, "gender_source must be 0 (none), 1 (female) or 2 (male)")
+	}
+	if options.GenderTarget < 0 || options.GenderTarget > 2 {
+		problems = append(problems, "gender_target must be 0 (none), 1 (female) or 2 (male)")
+	}
+	if options.MaskFace < 0 || options.MaskFace > 1 {
+		problems = append(problems, "mask_face must be 0 or 1")
+	}
+	if options.SelectSource < 0 || options.SelectSource > 1 {
+		problems = append(problems, "select_source must be 0 (image) or 1 (face model)")
+	}
+	if len(options.SourceFacesIndex) == 0 || len(options.FacesIndex) == 0 {
+		problems = append(problems, "source_faces_index and face_index must not be empty")
+	} else if len(options.SourceFacesIndex) != len(options.FacesIndex) {
+		problems = append(problems, "source_faces_index and face_index must have the same number of entries")
+	}
+	for _, index := range append(append([]int{}, options.SourceFacesIndex...), options.FacesIndex...) {
+		if index < 0 {
+			problems = append(problems, "face indexes must not be negative")
+			break
+		}
+	}
+	if options.SelectSource == 1 && strings.TrimSpace(options.FaceModel) == "" {
+		problems = append(problems, "face_model must not be empty")
+	}
+	if options.SelectSource == 0 && len(options.sourceImage) == 0 {
+		problems = append(problems, "select_source 0 requires at least one source_image")
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("%s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+func getFormValue(multipartForm *multipart.Form, names ...string) (string, bool) {
+	for _, name := range names {
+		var values, found = multipartForm.Value[name]
+		if found && len(values) > 0 && strings.TrimSpace(values[0]) != "" {
+			return strings.TrimSpace(values[0]), true
+		}
+	}
+	return "", false
+}
+
+func parseIndexes(value string) ([]int, error) {
+	var indexes = []int{}
+	for _, part := range strings.Split(value, ",") {
+		var index, err = strconv.Atoi(strings.TrimSpace(part))
+		if err != nil {
+			return nil, err
+		}
+		indexes = append(indexes, index)
+	}
+	return indexes, nil
+}
+
+func applyFormOptions(options *reactorOptions, multipartForm *multipart.Form) error {
+	var stringFields = map[string]*string{
+		"face_restorer": &options.FaceRestorer,
+		"device":        &options.Device,
+		"upscaler":      &options.Upscaler,
+		"face_model":    &options.FaceModel,
+	}
+	for name, field := range stringFields {
+		if value, found := getFormValue(multipartForm, name); found {
+			*field = value
+		}
+	}
+	var floatFields = map[string]*float64{
+		"restorer_visibility": &options.RestorerVisibility,
+		"codeformer_weight":   &options.CodeFormerWeight,
+		"scale":               &options.Scale,
+		"upscale_visibility":  &options.UpscaleVisibility,
+	}
+	for name, field := range floatFields {
+		var value, found = getFormValue(multipartForm, name)
+		if name == "codeformer_weight" && !found {
+			value, found = getFormValue(multipartForm, "codeformerweight")
+		}
+		if !found {
+			continue
+		}
+		var parsed, err = strconv.ParseFloat(value, 64)
+		if err != nil {
+			return fmt.Errorf("%s is not a number: %q", name, value)
+		}
+		*field = parsed
+	}
+	var intFields = map[string]*int{
+		"gender_source": &options.GenderSource,
+		"gender_target": &options.GenderTarget,
+		"mask_face":     &options.MaskFace,
+		"select_source": &options.SelectSource,
+	}
+	for name, field := range intFields {
+		if value, found := getFormValue(multipartForm, name); found {
+			var parsed, err = strconv.Atoi(value)
+			if err != nil {
+				return fmt.Errorf("%s is not an integer: %q", name, value)
+			}
+			*field = parsed
+		}
+	}
+	var indexFields = map[string]*[]int{
+		"source_faces_index": &options.SourceFacesIndex,
+		"face_index":         &options.FacesIndex,
+	}
+	for name, field := range indexFields {
+		if value, found := getFormValue(multipartForm, name); found {
+			var parsed, err = parseIndexes(value)
+			if err != nil {
+				return fmt.Errorf("%s is not a comma separated list of integers: %q", name, value)
+			}
+			*field = parsed
+		}
+	}
+	return nil
+}
+
+func getReactorOptions(multipartForm *multipart.Form) (reactorOptions, error) {
+	var presetName, found = getFormValue(multipartForm, "preset")
+	if !found {
+		presetName = DEFAULT_PRESET
+	}
+	var options, presetError = getPresetOptions(presetName)
+	if presetError != nil {
+		return options, webserver.GetBadRequest(presetError.Error())
+	}
+	var explicit = map[string]json.RawMessage{}
+	if content, found := getFormValue(multipartForm, "options"); found {
+		var contentError = json.Unmarshal([]byte(content), &options)
+		if contentError != nil {
+			return options, webserver.GetBadRequest("options is not valid JSON", contentError)
+		}
+		json.Unmarshal([]byte(content), &explicit)
+	}
+	for _, name := range []string{"source_faces_index", "face_index"} {
+		if _, found := getFormValue(multipartForm, name); found {
+			explicit[name] = nil
+		}
+	}
+	var formError = applyFormOptions(&options, multipartForm)
+	if formError != nil {
+		return options, webserver.GetBadRequest(formError.Error())
+	}
+	options.FaceModel = normalizeFaceModel(options.FaceModel)
+	options.normalize()
+	var _, sourceIndexSet = explicit["source_faces_index"]
+	var _, faceIndexSet = explicit["face_index"]
+	var sourceError = applySourceImages(&options, multipartForm, sourceIndexSet, faceIndexSet)
+	if sourceError != nil {
+		return options, sourceError
+	}
+	var validateError = options.validate()
+	if validateError != nil {
+		return options, webserver.GetBadRequest(validateError.Error())
+	}
+	return options, nil
+}
+
+func getFaceIndexes(count int) []int {
+	var indexes = make([]int, 0, count)
+	for index := 0; index < count; index++ {
+		indexes = append(indexes, index)
+	}
+	return indexes
+}
+
+func applySourceImages(
+	options *reactorOptions,
+	multipartForm *multipart.Form,
+	sourceIndexSet bool,
+	faceIndexSet bool,
+) error {
+	var sourceImageBytes, sourceImageErr = getImageBytes(
+		multipartForm,
+		"source_image",
+	)
+	if sourceImageErr != nil {
+		return sourceImageErr
+	}
+	if len(sourceImageBytes) == 0 {
+		return nil
+	}
+	var sourceImage, sourceImageError = combineSourceImages(sourceImageBytes)
+	if sourceImageError != nil {
+		return webserver.GetBadRequest(sourceImageError.Error())
+	}
+	options.sourceImage = sourceImage
+	options.SelectSource = 0
+	options.FaceModel = "None"
+	if len(sourceImageBytes) == 1 {
+		return nil
+	}
+	var count = len(sourceImageBytes)
+	if faceIndexSet {
+		count = len(options.FacesIndex)
+	}
+	if !sourceIndexSet {
+		options.SourceFacesIndex = getFaceIndexes(count)
+	}
+	if !faceIndexSet {
+		options.FacesIndex = getFaceIndexes(len(options.SourceFacesIndex))
+	}
+	return nil
+}
+
+type presetList struct {
+	Presets map[string]reactorOptions `json:"presets"`
+}
+
+func listPresetsAction(session webserver.Session) (interface{}, error) {
+	var presets = map[string]reactorOptions{}
+	for _, name := range getPresetNames() {
+		var options, optionsError = getPresetOptions(name)
+		if optionsError != nil {
+			return nil, optionsError
+		}
+		presets[name] = options
+	}
+	return presetList{
+		Presets: presets,
+	}, nil
+}
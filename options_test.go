@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"image"
+	"mime/multipart"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func newTestForm(t *testing.T, values map[string]string, files map[string][][]byte) *multipart.Form {
+	var body bytes.Buffer
+	var writer = multipart.NewWriter(&body)
+	for name, value := range values {
+		writer.WriteField(name, value)
+	}
+	for field, contents := range files {
+		for index, content := range contents {
+			var part, _ = writer.CreateFormFile(field, field+string(rune('a'+index))+".png")
+			part.Write(content)
+		}
+	}
+	writer.Close()
+	var form, err = multipart.NewReader(&body, writer.Boundary()).ReadForm(1 << 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return form
+}
+
+func TestNormalizeAndValidateOptions(t *testing.T) {
+	var options = defaultReactorOptions.clone()
+	options.FaceRestorer = " gfpgan "
+	options.Device = "cpu"
+	options.normalize()
+	if options.FaceRestorer != "GFPGAN" || options.Device != "CPU" || options.validate() != nil {
+		t.Fatalf("unexpected normalized options %+v", options)
+	}
+	for expected, mutate := range map[string]func(options *reactorOptions){
+		"face_restorer":       func(options *reactorOptions) { options.FaceRestorer = "Magic" },
+		"device":              func(options *reactorOptions) { options.Device = "TPU" },
+		"upscaler":            func(options *reactorOptions) { options.Upscaler = "" },
+		"restorer_visibility": func(options *reactorOptions) { options.RestorerVisibility = 2 },
+		"scale":               func(options *reactorOptions) { options.Scale = 9 },
+		"gender_target":       func(options *reactorOptions) { options.GenderTarget = 3 },
+		"same number":         func(options *reactorOptions) { options.FacesIndex = []int{0, 1} },
+		"must not be negative": func(options *reactorOptions) {
+			options.SourceFacesIndex = []int{-1}
+		},
+		"face_model must not be empty": func(options *reactorOptions) { options.FaceModel = " " },
+		"requires at least one source": func(options *reactorOptions) { options.SelectSource = 0 },
+	} {
+		var options = defaultReactorOptions.clone()
+		mutate(&options)
+		var err = options.validate()
+		if err == nil || !strings.Contains(err.Error(), expected) {
+			t.Errorf("%s: unexpected validation result %v", expected, err)
+		}
+	}
+}
+
+func TestCloneCopiesIndexes(t *testing.T) {
+	var options = defaultReactorOptions.clone()
+	options.FacesIndex[0] = 7
+	if defaultReactorOptions.FacesIndex[0] != 0 {
+		t.Fatal("clone must not share index slices with the defaults")
+	}
+}
+
+func TestReactorOptionsPrecedence(t *testing.T) {
+	var options, err = getReactorOptions(newTestForm(t, map[string]string{
+		"preset":             "quality",
+		"options":            `{"scale": 3, "device": "cpu", "mask_face": 0}`,
+		"scale":              "4",
+		"codeformerweight":   "0.2",
+		"face_index":         "1, 2",
+		"source_faces_index": "0,0",
+		"face_model":         "alice",
+	}, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if options.Upscaler != "R-ESRGAN 4x+" || options.Scale != 4 || options.Device != "CPU" || options.MaskFace != 0 {
+		t.Fatalf("expected preset < options < form fields, got %+v", options)
+	}
+	if options.CodeFormerWeight != 0.2 || options.FaceModel != "alice.safetensors" {
+		t.Fatalf("expected legacy and face model fields to apply, got %+v", options)
+	}
+	if !reflect.DeepEqual(options.FacesIndex, []int{1, 2}) || !reflect.DeepEqual(options.SourceFacesIndex, []int{0, 0}) {
+		t.Fatalf("unexpected indexes %v %v", options.SourceFacesIndex, options.FacesIndex)
+	}
+	for _, values := range []map[string]string{
+		{"preset": "missing"},
+		{"options": "{"},
+		{"scale": "big"},
+		{"face_index": "1,x"},
+		{"scale": "0"},
+	} {
+		if _, err := getReactorOptions(newTestForm(t, values, nil)); err == nil {
+			t.Errorf("%v: expected a bad request", values)
+		}
+	}
+}
+
+func TestPresets(t *testing.T) {
+	var saved = reactorPresets
+	t.Cleanup(func() {
+		reactorPresets = saved
+	})
+	reactorPresets = map[string]json.RawMessage{}
+	for name, preset := range saved {
+		reactorPresets[name] = preset
+	}
+	var fast, err = getPresetOptions("fast")
+	if err != nil || fast.FaceRestorer != "None" || fast.Device != defaultReactorOptions.Device {
+		t.Fatalf("unexpected fast preset %+v %v", fast, err)
+	}
+	var file = filepath.Join(t.TempDir(), "presets.json")
+	os.WriteFile(file, []byte(`{"portrait": {"face_restorer": "gfpgan", "scale": 2}}`), 0644)
+	if err := loadPresetsFile(file); err != nil {
+		t.Fatal(err)
+	}
+	var portrait, _ = getPresetOptions("portrait")
+	if portrait.FaceRestorer != "GFPGAN" || portrait.Scale != 2 {
+		t.Fatalf("unexpected loaded preset %+v", portrait)
+	}
+	if names := getPresetNames(); !sort.StringsAreSorted(names) || len(names) != len(saved)+1 {
+		t.Fatalf("unexpected preset names %v", names)
+	}
+	os.WriteFile(file, []byte(`{"broken": {"scale": 20}}`), 0644)
+	if err := loadPresetsFile(file); err == nil || !strings.Contains(err.Error(), "broken") {
+		t.Fatalf("expected an invalid preset to be rejected, got %v", err)
+	}
+	if _, found := reactorPresets["broken"]; found {
+		t.Fatal("an invalid preset must not be registered")
+	}
+}
+
+func TestSourceImagesReplaceTheFaceModel(t *testing.T) {
+	var source = getTestPNG(t)
+	var options, err = getReactorOptions(newTestForm(t, nil, map[string][][]byte{
+		"source_image": {source},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if options.SelectSource != 0 || options.FaceModel != "None" || !bytes.Equal(options.sourceImage, source) {
+		t.Fatalf("expected a single source image to be used as is, got %+v", options)
+	}
+	if !reflect.DeepEqual(options.SourceFacesIndex, []int{0}) || !reflect.DeepEqual(options.FacesIndex, []int{0}) {
+		t.Fatalf("a single source should keep the default indexes, got %v %v", options.SourceFacesIndex, options.FacesIndex)
+	}
+}
+
+func TestSeveralSourceImagesAreCombined(t *testing.T) {
+	var source = getTestPNG(t)
+	var single, _, _ = image.DecodeConfig(bytes.NewReader(source))
+	var options, err = getReactorOptions(newTestForm(t, nil, map[string][][]byte{
+		"source_image": {source, source, source},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var combined, _, combinedErr = image.DecodeConfig(bytes.NewReader(options.sourceImage))
+	if combinedErr != nil || combined.Width != 3*single.Width || combined.Height != single.Height {
+		t.Fatalf("expected the sources side by side, got %+v %v", combined, combinedErr)
+	}
+	if !reflect.DeepEqual(options.SourceFacesIndex, []int{0, 1, 2}) || !reflect.DeepEqual(options.FacesIndex, []int{0, 1, 2}) {
+		t.Fatalf("expected one face per source, got %v %v", options.SourceFacesIndex, options.FacesIndex)
+	}
+	options, err = getReactorOptions(newTestForm(t, map[string]string{"face_index": "4"}, map[string][][]byte{
+		"source_image": {source, source},
+	}))
+	if err != nil || !reflect.DeepEqual(options.SourceFacesIndex, []int{0}) || !reflect.DeepEqual(options.FacesIndex, []int{4}) {
+		t.Fatalf("explicit face indexes should limit the sources, got %v %v %v", options.SourceFacesIndex, options.FacesIndex, err)
+	}
+	if _, err := getReactorOptions(newTestForm(t, nil, map[string][][]byte{
+		"source_image": {source, []byte("not an image")},
+	})); err == nil {
+		t.Fatal("expected an undecodable source image to be rejected")
+	}
+}
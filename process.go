@@ -2,40 +2,82 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
 	"fmt"
 	"math"
 	"mime/multipart"
+	"net"
 	"net/http"
 	"os"
 	"strconv"
 	"strings"
-	"sync"
+	"time"
 
 	webserver "github.com/zhongjie-cai/web-server"
 )
 
 type item struct {
+	counter          int
+	imageProcessor   processor
 	targetImageBytes []imageBytes
 	namePrefix       string
 	reactorAPI       string
 	quality          int
-	weight           float64
-	batches          int
+	options          reactorOptions
+	start            int
+	end              int
+	priority         int
+	submitter        string
+	retryOf          int
+	carried          []imageBytes
+	pending          []int
+	archive          *archiveWriter
 	session          webserver.SessionLogging
 }
 
-var queue = make(chan item, 64)
+type sessionLoggingKey struct{}
 
-type progress struct {
-	total   int
-	current int
-	file    string
-	counter int
+func withSessionLogging(ctx context.Context, session webserver.SessionLogging) context.Context {
+	return context.WithValue(ctx, sessionLoggingKey{}, session)
 }
 
-var statusList = map[int]*progress{}
+func logBackgroundLogic(
+	ctx context.Context,
+	logLevel webserver.LogLevel,
+	category string,
+	subcategory string,
+	messageFormat string,
+	parameters ...interface{},
+) {
+	var session, found = ctx.Value(sessionLoggingKey{}).(webserver.SessionLogging)
+	if !found || session == nil {
+		session = appSession
+	}
+	if session == nil {
+		return
+	}
+	session.LogMethodLogic(
+		logLevel,
+		category,
+		subcategory,
+		messageFormat,
+		parameters...,
+	)
+}
+
+type submittedJob struct {
+	Counter     int    `json:"counter"`
+	Start       int    `json:"start"`
+	End         int    `json:"end"`
+	StatusURL   string `json:"status_url"`
+	DownloadURL string `json:"download_url"`
+}
 
-var statusListLock = sync.RWMutex{}
+type submittedJobs struct {
+	Jobs []submittedJob `json:"jobs"`
+}
 
 func getImageBytes(multipartForm *multipart.Form, filename string) ([]imageBytes, error) {
 	var files, found = multipartForm.File[filename]
@@ -70,12 +112,9 @@ func getNamePrefix(multipartForm *multipart.Form) string {
 	return namePrefixes[0]
 }
 
-func getReactorAPI(multipartForm *multipart.Form) string {
-	var reactorAPI, found = multipartForm.Value["reactor_api"]
-	if !found || len(reactorAPI) == 0 {
-		reactorAPI = []string{"http://localhost:7860/reactor/image"}
-	}
-	return reactorAPI[0]
+func getReactorAPI(multipartForm *multipart.Form, imageProcessor processor) (string, error) {
+	var reactorAPI, _ = getFormValue(multipartForm, "reactor_api")
+	return imageProcessor.Endpoint(reactorAPI)
 }
 
 func getImageQuality(multipartForm *multipart.Form) int {
@@ -102,36 +141,207 @@ func getSplitBatches(multipartForm *multipart.Form) int {
 	return batch
 }
 
-func getCodeFormerWeight(multipartForm *multipart.Form) float64 {
-	var weights, found = multipartForm.Value["codeformerweight"]
-	if !found || len(weights) == 0 {
-		return 0.5
+func getPriority(request *http.Request) int {
+	var value = request.Header.Get("X-Priority")
+	if request.MultipartForm != nil {
+		var priorities, found = request.MultipartForm.Value["priority"]
+		if found && len(priorities) > 0 {
+			value = priorities[0]
+		}
+	}
+	var priority, err = strconv.Atoi(strings.TrimSpace(value))
+	if err != nil {
+		return 0
+	}
+	if priority > appConfig.MaxPriority {
+		return appConfig.MaxPriority
+	}
+	if priority < 0 {
+		return 0
+	}
+	return priority
+}
+
+func getSubmitter(request *http.Request) string {
+	var apiKey = request.Header.Get("X-API-Key")
+	if apiKey != "" {
+		var digest = sha256.Sum256([]byte(apiKey))
+		return fmt.Sprintf("key:%x", digest[:6])
 	}
-	var weight, err = strconv.ParseFloat(weights[0], 64)
+	var host, _, err = net.SplitHostPort(request.RemoteAddr)
 	if err != nil {
-		return 0.5
+		host = request.RemoteAddr
+	}
+	return fmt.Sprint("ip:", host)
+}
+
+func getBatchRanges(count int, batches int) [][2]int {
+	if batches < 1 {
+		batches = 1
+	}
+	var size = int(math.Ceil(float64(count) / float64(batches)))
+	var ranges = [][2]int{}
+	for i := 0; i < batches; i++ {
+		var start = i * size
+		var end = start + size
+		if end > count {
+			end = count
+		}
+		if start >= end {
+			break
+		}
+		ranges = append(ranges, [2]int{start, end})
+	}
+	return ranges
+}
+
+func createBatchJob(batchItem item) (int, error) {
+	var images = make([]imageOutcome, 0, len(batchItem.targetImageBytes))
+	var inputBytes int64
+	for _, target := range batchItem.targetImageBytes {
+		images = append(images, imageOutcome{
+			Name: target.name,
+		})
+		inputBytes += int64(len(target.bytes))
 	}
-	return weight
+	var carriedOver = []string{}
+	for _, carried := range batchItem.carried {
+		carriedOver = append(carriedOver, carried.name)
+	}
+	return jobs.Create(&job{
+		RetryOf:     batchItem.retryOf,
+		CarriedOver: carriedOver,
+		State:      JOB_STATE_QUEUED,
+		NamePrefix: batchItem.namePrefix,
+		Processor:  batchItem.imageProcessor.Name(),
+		ReactorAPI: batchItem.reactorAPI,
+		Quality:    batchItem.quality,
+		Options:    batchItem.options,
+		Priority:   batchItem.priority,
+		Submitter:  batchItem.submitter,
+		Total:      len(batchItem.targetImageBytes),
+		InputBytes: inputBytes,
+		Images:     images,
+	})
+}
+
+func getBatchContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if appConfig.BatchTimeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, appConfig.BatchTimeout)
+}
+
+func writeBatchErrorLog(batchItem item, errData error) string {
+	var filename, writeError = writeErrorLog(
+		batchItem.namePrefix,
+		batchItem.counter,
+		errData,
+	)
+	if writeError != nil {
+		batchItem.session.LogMethodLogic(
+			webserver.LogLevelError,
+			"process",
+			"writeBatchErrorLog",
+			"Failed to write the error log of item no.%04d: %v",
+			batchItem.counter,
+			writeError,
+		)
+	}
+	return filename
 }
 
 func processBatch(
-	counter int,
 	batchItem item,
-	start int,
-	end int,
-	session webserver.SessionLogging,
 ) {
-	if end > len(batchItem.targetImageBytes) {
-		end = len(batchItem.targetImageBytes)
+	var counter = batchItem.counter
+	var start = batchItem.start
+	var end = batchItem.end
+	var session = batchItem.session
+	var control, found = controls.get(counter)
+	if !found || (control.ctx.Err() != nil && batchItem.archive == nil) {
+		session.LogMethodLogic(
+			webserver.LogLevelInfo,
+			"process",
+			"processBatch",
+			"Skip canceled item no.%04d - batch from %d to %d: %s",
+			counter,
+			start,
+			end,
+			batchItem.namePrefix,
+		)
+		return
 	}
-	var progress = &progress{
-		total:   end-start,
-		current: 0,
-		counter: counter,
+	var suspended = false
+	defer func() {
+		if !suspended {
+			controls.remove(counter)
+		}
+	}()
+	if batchItem.archive == nil && control.suspend(batchItem) {
+		suspended = true
+		session.LogMethodLogic(
+			webserver.LogLevelInfo,
+			"process",
+			"processBatch",
+			"Suspend paused item no.%04d - batch from %d to %d: %s",
+			counter,
+			start,
+			end,
+			batchItem.namePrefix,
+		)
+		return
 	}
-	statusListLock.Lock()
-	statusList[counter] = progress
-	statusListLock.Unlock()
+	activeBatches.Add(1)
+	defer activeBatches.Done()
+	var batchCtx, cancelBatch = getBatchContext(
+		withSessionLogging(control.ctx, session),
+	)
+	defer cancelBatch()
+	var archive = batchItem.archive
+	var archiveErr error
+	if archive == nil {
+		archive, archiveErr = newArchiveWriter(
+			getArchiveName(batchItem.namePrefix, counter),
+		)
+		for _, carried := range batchItem.carried {
+			if archiveErr == nil {
+				archiveErr = archive.add(carried)
+			}
+		}
+	}
+	if archiveErr != nil {
+		if archive != nil {
+			archive.abort()
+		}
+		var filename = writeBatchErrorLog(batchItem, archiveErr)
+		jobs.Update(
+			counter,
+			func(job *job) {
+				var finishedAt = time.Now()
+				job.File = filename
+				job.FinishedAt = &finishedAt
+				job.InputsKeptUntil = getInputsKeptUntil()
+				job.State = JOB_STATE_FAILED
+				job.Error = archiveErr.Error()
+			},
+		)
+		return
+	}
+	jobs.Update(
+		counter,
+		func(job *job) {
+			var startedAt = time.Now()
+			job.State = JOB_STATE_RUNNING
+			if control.isPaused() {
+				job.State = JOB_STATE_PAUSED
+			}
+			if job.StartedAt == nil {
+				job.StartedAt = &startedAt
+			}
+			job.PartialFile = archive.name
+		},
+	)
 	session.LogMethodLogic(
 		webserver.LogLevelInfo,
 		"process",
@@ -142,25 +352,94 @@ func processBatch(
 		end,
 		batchItem.namePrefix,
 	)
-	var outImageBytes = processImage(
-		batchItem.targetImageBytes[start:end],
-		batchItem.namePrefix,
-		batchItem.reactorAPI,
-		batchItem.quality,
-		batchItem.weight,
-		progress,
-	)
-	var archiveErr = writeArchive(
-		outImageBytes,
-		batchItem.namePrefix,
-		progress,
-	)
-	if archiveErr != nil {
-		writeErrorLog(
+	var pending = batchItem.pending
+	if pending == nil {
+		pending = getAllIndexes(len(batchItem.targetImageBytes))
+	}
+	var processErr error
+	for {
+		_, pending, processErr = processImage(
+			batchCtx,
+			batchItem.imageProcessor,
+			batchItem.targetImageBytes,
+			pending,
 			batchItem.namePrefix,
-			archiveErr,
-			progress,
+			batchItem.reactorAPI,
+			batchItem.quality,
+			batchItem.options,
+			counter,
+			control,
+			archive,
+		)
+		if len(pending) == 0 || batchCtx.Err() != nil || processErr != nil {
+			break
+		}
+		batchItem.pending = pending
+		batchItem.archive = archive
+		if control.suspend(batchItem) {
+			suspended = true
+			session.LogMethodLogic(
+				webserver.LogLevelInfo,
+				"process",
+				"processBatch",
+				"Suspend paused item no.%04d - batch from %d to %d: %s",
+				counter,
+				start,
+				end,
+				batchItem.namePrefix,
+			)
+			return
+		}
+	}
+	var canceled = control.ctx.Err() != nil
+	var interrupted = appContext.Err() != nil
+	if canceled && archive.count() == 0 && processErr == nil {
+		archive.abort()
+		jobs.Update(
+			counter,
+			func(job *job) {
+				var finishedAt = time.Now()
+				job.PartialFile = ""
+				job.FinishedAt = &finishedAt
+				job.InputsKeptUntil = getInputsKeptUntil()
+				job.State = JOB_STATE_CANCELED
+				if interrupted {
+					job.State = JOB_STATE_FAILED
+					job.Error = "interrupted by server shutdown"
+				}
+			},
 		)
+		return
+	}
+	var filename string
+	filename, archiveErr = archive.close()
+	if archiveErr != nil && filename == "" {
+		filename = writeBatchErrorLog(batchItem, archiveErr)
+	}
+	jobs.Update(
+		counter,
+		func(job *job) {
+			var finishedAt = time.Now()
+			job.File = filename
+			job.PartialFile = ""
+			job.FinishedAt = &finishedAt
+			job.InputsKeptUntil = getInputsKeptUntil()
+			job.State = JOB_STATE_DONE
+			if canceled {
+				job.State = JOB_STATE_CANCELED
+			}
+			if interrupted {
+				job.State = JOB_STATE_FAILED
+				job.Error = "interrupted by server shutdown"
+			}
+			if archiveErr != nil {
+				job.State = JOB_STATE_FAILED
+				job.Error = archiveErr.Error()
+			}
+		},
+	)
+	if archiveErr == nil {
+		deleteArchivedResults(counter)
 	}
 	session.LogMethodLogic(
 		webserver.LogLevelInfo,
@@ -174,53 +453,214 @@ func processBatch(
 	)
 }
 
-func initCounter() int {
-	var allEntries, allEntriesError = os.ReadDir(".")
+func getFinishedState(filename string) jobState {
+	if filename == "" || strings.HasSuffix(filename, ".error.log") {
+		return JOB_STATE_FAILED
+	}
+	return JOB_STATE_DONE
+}
+
+func restoreJobs() {
+	var known = map[string]bool{}
+	for _, entry := range jobs.List() {
+		known[entry.File] = true
+		if entry.FinishedAt == nil {
+			var salvaged, recovered = "", 0
+			if entry.PartialFile != "" {
+				var salvageError error
+				salvaged, recovered, salvageError = salvageArchive(entry.PartialFile)
+				if salvageError != nil && !errors.Is(salvageError, os.ErrNotExist) {
+					logBackgroundLogic(
+						context.Background(),
+						webserver.LogLevelError,
+						"process",
+						"restoreJobs",
+						"Unable to salvage partial archive %s: %v",
+						entry.PartialFile,
+						salvageError,
+					)
+				}
+			}
+			known[salvaged] = true
+			jobs.Update(
+				entry.Counter,
+				func(job *job) {
+					var finishedAt = time.Now()
+					job.State = JOB_STATE_FAILED
+					job.Error = "interrupted by server restart"
+					if appConfig.Storage == "s3" {
+						job.Error = "interrupted by server restart, unfinished S3 archives are staged locally and cannot be salvaged"
+					}
+					if recovered > 0 {
+						job.File = salvaged
+						job.Error = fmt.Sprintf(
+							"interrupted by server restart, %d finished entries recovered",
+							recovered,
+						)
+					}
+					job.PartialFile = ""
+					job.FinishedAt = &finishedAt
+					job.InputsKeptUntil = getInputsKeptUntil()
+				},
+			)
+		} else if entry.State == "" {
+			jobs.Update(
+				entry.Counter,
+				func(job *job) {
+					job.State = getFinishedState(job.File)
+				},
+			)
+		}
+	}
+	var allEntries, allEntriesError = outputs.List("")
 	if allEntriesError != nil {
-		fmt.Print(
-			"Unable to read working directory entries: ",
-			allEntriesError.Error(),
+		logBackgroundLogic(
+			context.Background(),
+			webserver.LogLevelError,
+			"process",
+			"restoreJobs",
+			"Unable to read output storage entries: %v",
+			allEntriesError,
 		)
-		return 0
+		return
 	}
-	var counter = 0
 	for _, entry := range allEntries {
-		var entryName = entry.Name()
+		var entryName = entry.Name
+		if known[entryName] || strings.Contains(entryName, "/") {
+			continue
+		}
 		if strings.HasSuffix(entryName, ".error.log") ||
 			strings.HasSuffix(entryName, ".cache.zip") {
-			counter++
-			statusListLock.Lock()
-			statusList[counter] = &progress{
-				file:    entryName,
-				counter: counter,
-			}
-			statusListLock.Unlock()
+			var createdAt = entry.ModTime
+			jobs.Create(&job{
+				State:      getFinishedState(entryName),
+				File:       entryName,
+				CreatedAt:  createdAt,
+				FinishedAt: &createdAt,
+			})
 		}
 	}
-	return counter
 }
 
 func doProcessing() {
-	var counter = initCounter()
-	for item := range queue {
-		var count = float64(len(item.targetImageBytes))
-		var size = int(math.Ceil(count / float64(item.batches)))
-		for i := 0; i < item.batches; i++ {
-			counter++
-			processBatch(
-				counter,
-				item,
-				i * size,
-				i * size + size,
-				item.session,
-			)
+	for {
+		var next, waiting = queue.pop()
+		next.session.LogMethodLogic(
+			webserver.LogLevelInfo,
+			"process",
+			"doProcessing",
+			"Scheduled item no.%04d for submitter %s at priority %d (%d still waiting)",
+			next.counter,
+			next.submitter,
+			next.priority,
+			waiting,
+		)
+		processBatch(next)
+	}
+}
+
+func discardBatches(batchItems []item) {
+	for _, batchItem := range batchItems {
+		controls.remove(batchItem.counter)
+		deleteJobInputs(batchItem.counter)
+		deleteJobResults(batchItem.counter)
+		jobs.Delete(batchItem.counter)
+	}
+}
+
+func writeQueueFullResponse(session webserver.Session) (interface{}, error) {
+	var responseWriter = session.GetResponseWriter()
+	responseWriter.Header().Set(
+		"Retry-After",
+		strconv.Itoa(appConfig.RetryAfterSeconds),
+	)
+	return writeJSONResponse(
+		responseWriter,
+		http.StatusServiceUnavailable,
+		webserver.GetGeneralFailure(errQueueFull.Error()),
+	)
+}
+
+func submitBatches(batchItems []item) ([]submittedJob, error) {
+	if queue.available() < len(batchItems) {
+		return nil, errQueueFull
+	}
+	quotaLock.Lock()
+	defer quotaLock.Unlock()
+	var quotaError = checkStorageQuota(
+		batchItems[0].submitter,
+		getUploadFootprint(batchItems),
+	)
+	if quotaError != nil {
+		return nil, quotaError
+	}
+	var submitted = []submittedJob{}
+	for index := range batchItems {
+		var counter, createError = createBatchJob(batchItems[index])
+		if createError != nil {
+			discardBatches(batchItems[:index])
+			return nil, createError
+		}
+		batchItems[index].counter = counter
+		var inputsError = saveJobInputs(counter, batchItems[index].targetImageBytes)
+		if inputsError == nil {
+			inputsError = saveJobSource(counter, batchItems[index].options)
+		}
+		if inputsError != nil {
+			discardBatches(batchItems[:index+1])
+			return nil, inputsError
 		}
+		controls.register(counter)
+		submitted = append(submitted, submittedJob{
+			Counter:     counter,
+			Start:       batchItems[index].start,
+			End:         batchItems[index].end,
+			StatusURL:   fmt.Sprint("/jobs/", counter),
+			DownloadURL: fmt.Sprint("/dl/", counter),
+		})
+	}
+	var pushError = queue.push(batchItems...)
+	if pushError != nil {
+		discardBatches(batchItems)
+		return nil, pushError
 	}
+	return submitted, nil
+}
+
+func enqueueBatches(
+	imageProcessor processor,
+	targetImageBytes []imageBytes,
+	namePrefix string,
+	reactorAPI string,
+	quality int,
+	options reactorOptions,
+	batches int,
+	priority int,
+	submitter string,
+	session webserver.SessionLogging,
+) ([]submittedJob, error) {
+	var batchItems = []item{}
+	for _, batchRange := range getBatchRanges(len(targetImageBytes), batches) {
+		batchItems = append(batchItems, item{
+			imageProcessor:   imageProcessor,
+			targetImageBytes: targetImageBytes[batchRange[0]:batchRange[1]],
+			namePrefix:       namePrefix,
+			reactorAPI:       reactorAPI,
+			quality:          quality,
+			options:          options,
+			start:            batchRange[0],
+			end:              batchRange[1],
+			priority:         priority,
+			submitter:        submitter,
+			session:          session,
+		})
+	}
+	return submitBatches(batchItems)
 }
 
 func processAction(session webserver.Session) (interface{}, error) {
 	var request = session.GetRequest()
-	var parseErr = request.ParseMultipartForm(2097152)
+	var parseErr = request.ParseMultipartForm(int64(appConfig.MultipartMemory))
 	if parseErr != nil {
 		return nil, parseErr
 	}
@@ -231,20 +671,42 @@ func processAction(session webserver.Session) (interface{}, error) {
 	if targetImageErr != nil {
 		return nil, targetImageErr
 	}
+	var imageProcessor, processorErr = getSessionProcessor(session, request.MultipartForm)
+	if processorErr != nil {
+		return nil, processorErr
+	}
 	var namePrefix = getNamePrefix(request.MultipartForm)
-	var reactorAPI = getReactorAPI(request.MultipartForm)
+	var reactorAPI, reactorAPIErr = getReactorAPI(request.MultipartForm, imageProcessor)
+	if reactorAPIErr != nil {
+		return nil, reactorAPIErr
+	}
 	var quality = getImageQuality(request.MultipartForm)
 	var batches = getSplitBatches(request.MultipartForm)
-	var weight = getCodeFormerWeight(request.MultipartForm)
+	var options, optionsErr = getReactorOptions(request.MultipartForm)
+	if optionsErr != nil {
+		return nil, optionsErr
+	}
+	if len(targetImageBytes) == 0 {
+		return nil, webserver.GetBadRequest("no target_image uploaded")
+	}
 	if len(targetImageBytes) == 1 {
-		var outImageBytes = processImage(
+		var control = newJobControl(request.Context())
+		var outImageBytes, _, _ = processImage(
+			withSessionLogging(control.ctx, session),
+			imageProcessor,
 			targetImageBytes,
+			getAllIndexes(len(targetImageBytes)),
 			namePrefix,
 			reactorAPI,
 			quality,
-			weight,
+			options,
+			0,
+			control,
 			nil,
 		)
+		if len(outImageBytes) == 0 {
+			return nil, request.Context().Err()
+		}
 		var responseWriter = session.GetResponseWriter()
 		responseWriter.Header().Set(
 			"Content-Type",
@@ -262,17 +724,38 @@ func processAction(session webserver.Session) (interface{}, error) {
 		responseWriter.Write(outImageBytes[0].bytes)
 		return webserver.SkipResponseHandling()
 	} else {
-		queue <- item{
+		var submitted, submitError = enqueueBatches(
+			imageProcessor,
 			targetImageBytes,
 			namePrefix,
 			reactorAPI,
 			quality,
-			weight,
+			options,
 			batches,
+			getPriority(request),
+			getSubmitter(request),
 			session,
+		)
+		if errors.Is(submitError, errQueueFull) {
+			return writeQueueFullResponse(session)
+		}
+		if errors.Is(submitError, errQuotaExceeded) {
+			return writeQuotaExceededResponse(session, submitError)
+		}
+		if submitError != nil {
+			return nil, submitError
 		}
 		var responseWriter = session.GetResponseWriter()
-		responseWriter.WriteHeader(http.StatusNoContent)
-		return webserver.SkipResponseHandling()
+		responseWriter.Header().Set(
+			"Location",
+			submitted[0].StatusURL,
+		)
+		return writeJSONResponse(
+			responseWriter,
+			http.StatusAccepted,
+			submittedJobs{
+				Jobs: submitted,
+			},
+		)
 	}
 }
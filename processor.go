@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"mime/multipart"
+	"net/http"
+	"sort"
+	"strings"
+
+	webserver "github.com/zhongjie-cai/web-server"
+)
+
+type processor interface {
+	Name() string
+	Endpoint(requested string) (string, error)
+	Process(
+		ctx context.Context,
+		targetImage imageBytes,
+		namePrefix string,
+		endpoint string,
+		quality int,
+		options reactorOptions,
+	) (*imageBytes, []imageAttempt, error)
+}
+
+const DEFAULT_PROCESSOR string = "reactor"
+
+var processors = map[string]processor{
+	"reactor": reactorProcessor{},
+	"img2img": httpProcessor{},
+	"local":   localProcessor{},
+	"mock":    mockProcessor{},
+}
+
+func getProcessorNames() []string {
+	var names = make([]string, 0, len(processors))
+	for name := range processors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func getProcessor(name string) (processor, error) {
+	if name == "" {
+		name = DEFAULT_PROCESSOR
+	}
+	var found, ok = processors[strings.ToLower(name)]
+	if !ok {
+		return nil, webserver.GetBadRequest(
+			fmt.Sprintf(
+				"unknown processor %q, expecting one of %s",
+				name,
+				strings.Join(getProcessorNames(), ", "),
+			),
+		)
+	}
+	return found, nil
+}
+
+func getSessionProcessor(session webserver.Session, multipartForm *multipart.Form) (processor, error) {
+	var name string
+	var nameError = session.GetRequestParameter(
+		"processor",
+		&name,
+	)
+	if nameError != nil {
+		name, _ = getFormValue(multipartForm, "processor")
+	}
+	return getProcessor(name)
+}
+
+func encodeImage(imageBytes []byte, quality int) ([]byte, error) {
+	var decodedImage, _, decodeErr = image.Decode(bytes.NewReader(imageBytes))
+	if decodeErr != nil {
+		return nil, decodeErr
+	}
+	var buffer bytes.Buffer
+	var jpegErr = jpeg.Encode(
+		&buffer,
+		decodedImage,
+		&jpeg.Options{
+			Quality: quality,
+		},
+	)
+	if jpegErr != nil {
+		return nil, jpegErr
+	}
+	return buffer.Bytes(), nil
+}
+
+type reactorProcessor struct{}
+
+func (reactorProcessor) Name() string {
+	return "reactor"
+}
+
+func (reactorProcessor) Endpoint(requested string) (string, error) {
+	if requested == "" && backends.size() > 0 {
+		return BACKEND_POOL, nil
+	}
+	if requested == BACKEND_POOL && backends.size() == 0 {
+		return "", webserver.GetBadRequest("no reactor backend pool is configured")
+	}
+	if requested == "" {
+		return appConfig.DefaultReactorAPI, nil
+	}
+	if requested == BACKEND_POOL {
+		return requested, nil
+	}
+	return resolveBackendURL(requested, "/reactor/image")
+}
+
+func (reactorProcessor) Process(
+	ctx context.Context,
+	targetImage imageBytes,
+	namePrefix string,
+	endpoint string,
+	quality int,
+	options reactorOptions,
+) (*imageBytes, []imageAttempt, error) {
+	return callReactor(
+		ctx,
+		targetImage,
+		namePrefix,
+		endpoint,
+		quality,
+		options,
+	)
+}
+
+type httpProcessor struct{}
+
+func (httpProcessor) Name() string {
+	return "img2img"
+}
+
+func (httpProcessor) Endpoint(requested string) (string, error) {
+	if requested == "" {
+		return "", webserver.GetBadRequest("processor img2img requires a reactor_api endpoint")
+	}
+	return resolveBackendURL(requested, "")
+}
+
+func (httpProcessor) Process(
+	ctx context.Context,
+	targetImage imageBytes,
+	namePrefix string,
+	endpoint string,
+	quality int,
+	options reactorOptions,
+) (*imageBytes, []imageAttempt, error) {
+	var responseBytes, attempts, responseError = postReactorWithRetry(
+		ctx,
+		endpoint,
+		http.DetectContentType(targetImage.bytes),
+		targetImage.bytes,
+	)
+	if responseError != nil {
+		return nil, attempts, responseError
+	}
+	var resultImg, resultImgError = encodeImage(responseBytes, quality)
+	if resultImgError != nil {
+		return nil, attempts, fmt.Errorf("unexpected img2img response: %w", resultImgError)
+	}
+	return &imageBytes{
+		bytes: resultImg,
+		name:  getImageName(namePrefix),
+	}, attempts, nil
+}
+
+type localProcessor struct{}
+
+func (localProcessor) Name() string {
+	return "local"
+}
+
+func (localProcessor) Endpoint(requested string) (string, error) {
+	return "local", nil
+}
+
+func (localProcessor) Process(
+	ctx context.Context,
+	targetImage imageBytes,
+	namePrefix string,
+	endpoint string,
+	quality int,
+	options reactorOptions,
+) (*imageBytes, []imageAttempt, error) {
+	if ctx.Err() != nil {
+		return nil, nil, ctx.Err()
+	}
+	var flipImg, flipImgError = flipImage(targetImage.bytes, quality)
+	if flipImgError != nil {
+		return nil, nil, flipImgError
+	}
+	return &imageBytes{
+		bytes: flipImg,
+		name:  getImageName(namePrefix),
+	}, nil, nil
+}
+
+type mockProcessor struct{}
+
+func (mockProcessor) Name() string {
+	return "mock"
+}
+
+func (mockProcessor) Endpoint(requested string) (string, error) {
+	return "mock", nil
+}
+
+func (mockProcessor) Process(
+	ctx context.Context,
+	targetImage imageBytes,
+	namePrefix string,
+	endpoint string,
+	quality int,
+	options reactorOptions,
+) (*imageBytes, []imageAttempt, error) {
+	if ctx.Err() != nil {
+		return nil, nil, ctx.Err()
+	}
+	var resultImg, resultImgError = encodeImage(targetImage.bytes, quality)
+	if resultImgError != nil {
+		return nil, nil, resultImgError
+	}
+	return &imageBytes{
+		bytes: resultImg,
+		name:  getImageName(namePrefix),
+	}, nil, nil
+}
+
+type processorList struct {
+	Processors []string `json:"processors"`
+	Default    string   `json:"default"`
+}
+
+func listProcessorsAction(session webserver.Session) (interface{}, error) {
+	return processorList{
+		Processors: getProcessorNames(),
+		Default:    DEFAULT_PROCESSOR,
+	}, nil
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestGetProcessor(t *testing.T) {
+	for requested, expected := range map[string]string{
+		"":        DEFAULT_PROCESSOR,
+		"MOCK":    "mock",
+		"img2img": "img2img",
+		"local":   "local",
+	} {
+		var found, err = getProcessor(requested)
+		if err != nil || found.Name() != expected {
+			t.Errorf("%q: expected %s, got %v %v", requested, expected, found, err)
+		}
+	}
+	if _, err := getProcessor("gpu"); err == nil {
+		t.Fatal("expected an unknown processor to be rejected")
+	}
+	for name, registered := range processors {
+		if registered.Name() != name {
+			t.Errorf("processor registered as %s calls itself %s", name, registered.Name())
+		}
+	}
+}
+
+func assertProcessedJPEG(t *testing.T, name string, result *imageBytes, err error) {
+	if err != nil {
+		t.Fatalf("%s: %v", name, err)
+	}
+	var _, format, decodeErr = image.DecodeConfig(bytes.NewReader(result.bytes))
+	if decodeErr != nil || format != "jpeg" {
+		t.Fatalf("%s: expected a JPEG result, got %s %v", name, format, decodeErr)
+	}
+}
+
+func TestBuiltInProcessors(t *testing.T) {
+	var target = imageBytes{name: "a.png", bytes: getTestPNG(t)}
+	var canceled, cancel = context.WithCancel(context.Background())
+	cancel()
+	for _, name := range []string{"mock", "local"} {
+		var result, _, err = processors[name].Process(context.Background(), target, "IMG", name, 90, defaultReactorOptions)
+		assertProcessedJPEG(t, name, result, err)
+		if _, _, err := processors[name].Process(canceled, target, "IMG", name, 90, defaultReactorOptions); err == nil {
+			t.Errorf("%s: expected a canceled context to stop processing", name)
+		}
+		if _, _, err := processors[name].Process(context.Background(), imageBytes{bytes: []byte("x")}, "IMG", name, 90, defaultReactorOptions); err == nil {
+			t.Errorf("%s: expected an undecodable image to fail", name)
+		}
+	}
+}
+
+func TestReactorProcessorEndpoint(t *testing.T) {
+	var savedConfig, savedBackends = appConfig, backends
+	t.Cleanup(func() {
+		appConfig, backends = savedConfig, savedBackends
+	})
+	backends = newBackendPool(map[string]int{})
+	if endpoint, _ := (reactorProcessor{}).Endpoint(""); endpoint != appConfig.DefaultReactorAPI {
+		t.Fatalf("expected the default reactor API, got %s", endpoint)
+	}
+	if _, err := (reactorProcessor{}).Endpoint(BACKEND_POOL); err == nil {
+		t.Fatal("expected the pool to be refused without backends")
+	}
+	if endpoint, _ := (reactorProcessor{}).Endpoint("local"); endpoint != "http://localhost:7860/reactor/image" {
+		t.Fatalf("expected the named backend to resolve, got %s", endpoint)
+	}
+	backends = newBackendPool(map[string]int{"http://localhost:7860": 1})
+	if endpoint, _ := (reactorProcessor{}).Endpoint(""); endpoint != BACKEND_POOL {
+		t.Fatalf("expected the pool by default, got %s", endpoint)
+	}
+	if _, err := (httpProcessor{}).Endpoint(""); err == nil {
+		t.Fatal("expected img2img to require an endpoint")
+	}
+}
+
+func TestRemoteProcessors(t *testing.T) {
+	var savedConfig = appConfig
+	t.Cleanup(func() {
+		appConfig = savedConfig
+	})
+	appConfig.RetryCount = 0
+	var reactor = httptest.NewServer(newFakeReactor(0, 0, http.StatusServiceUnavailable).handler())
+	t.Cleanup(reactor.Close)
+	var echo = httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		if request.Header.Get("Content-Type") != "image/png" {
+			response.Write([]byte("not an image"))
+			return
+		}
+		var content bytes.Buffer
+		content.ReadFrom(request.Body)
+		response.Write(content.Bytes())
+	}))
+	t.Cleanup(echo.Close)
+	var target = imageBytes{name: "a.png", bytes: getTestPNG(t)}
+	var result, _, err = (reactorProcessor{}).Process(context.Background(), target, "IMG", reactor.URL+"/reactor/image", 90, defaultReactorOptions)
+	assertProcessedJPEG(t, "reactor", result, err)
+	result, _, err = (httpProcessor{}).Process(context.Background(), target, "IMG", echo.URL, 90, defaultReactorOptions)
+	assertProcessedJPEG(t, "img2img", result, err)
+	var jpegTarget = imageBytes{name: "a.jpg", bytes: result.bytes}
+	if _, _, err := (httpProcessor{}).Process(context.Background(), jpegTarget, "IMG", echo.URL, 90, defaultReactorOptions); err == nil {
+		t.Fatal("expected a non-image img2img response to fail")
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"errors"
+	"sync"
+)
+
+var errQueueFull = errors.New("processing queue is full")
+
+type jobQueue struct {
+	lock     sync.Mutex
+	ready    *sync.Cond
+	items    []item
+	capacity int
+	served   map[string]uint64
+	sequence uint64
+}
+
+var queue *jobQueue
+
+func newJobQueue(capacity int) *jobQueue {
+	var created = &jobQueue{
+		capacity: capacity,
+		served:   map[string]uint64{},
+	}
+	created.ready = sync.NewCond(&created.lock)
+	return created
+}
+
+func (queue *jobQueue) available() int {
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+	return queue.capacity - len(queue.items)
+}
+
+func (queue *jobQueue) push(items ...item) error {
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+	if len(queue.items)+len(items) > queue.capacity {
+		return errQueueFull
+	}
+	queue.items = append(queue.items, items...)
+	for range items {
+		queue.ready.Signal()
+	}
+	return nil
+}
+
+func getNextIndex(items []item, served map[string]uint64) int {
+	var next = -1
+	for index, candidate := range items {
+		if next < 0 {
+			next = index
+			continue
+		}
+		var current = items[next]
+		if candidate.priority != current.priority {
+			if candidate.priority > current.priority {
+				next = index
+			}
+			continue
+		}
+		if served[candidate.submitter] < served[current.submitter] {
+			next = index
+		}
+	}
+	return next
+}
+
+func (queue *jobQueue) pop() (item, int) {
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+	for len(queue.items) == 0 {
+		queue.ready.Wait()
+	}
+	var index = getNextIndex(queue.items, queue.served)
+	var next = queue.items[index]
+	queue.items = append(queue.items[:index], queue.items[index+1:]...)
+	queue.sequence++
+	queue.served[next.submitter] = queue.sequence
+	return next, len(queue.items)
+}
+
+func (queue *jobQueue) remove(counter int) bool {
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+	for index, queued := range queue.items {
+		if queued.counter == counter {
+			queue.items = append(queue.items[:index], queue.items[index+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func (queue *jobQueue) positions() map[int]int {
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+	var positions = make(map[int]int, len(queue.items))
+	var remaining = append([]item(nil), queue.items...)
+	var served = make(map[string]uint64, len(queue.served))
+	for submitter, sequence := range queue.served {
+		served[submitter] = sequence
+	}
+	var sequence = queue.sequence
+	for len(remaining) > 0 {
+		var index = getNextIndex(remaining, served)
+		sequence++
+		served[remaining[index].submitter] = sequence
+		positions[remaining[index].counter] = len(positions) + 1
+		remaining = append(remaining[:index], remaining[index+1:]...)
+	}
+	return positions
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func popCounters(queue *jobQueue, count int) []int {
+	var counters = []int{}
+	for i := 0; i < count; i++ {
+		var next, _ = queue.pop()
+		counters = append(counters, next.counter)
+	}
+	return counters
+}
+
+func TestQueueIsFairBetweenSubmitters(t *testing.T) {
+	var queue = newJobQueue(10)
+	queue.push(
+		item{counter: 1, submitter: "a"},
+		item{counter: 2, submitter: "a"},
+		item{counter: 3, submitter: "a"},
+	)
+	queue.push(item{counter: 4, submitter: "b"})
+	queue.push(item{counter: 5, submitter: "c"})
+	var expected = []int{1, 4, 5, 2, 3}
+	var positions = queue.positions()
+	for position, counter := range expected {
+		if positions[counter] != position+1 {
+			t.Errorf("job %d: expected position %d, got %d", counter, position+1, positions[counter])
+		}
+	}
+	if popped := popCounters(queue, 5); !reflect.DeepEqual(popped, expected) {
+		t.Fatalf("expected round-robin order %v, got %v", expected, popped)
+	}
+}
+
+func TestQueueServesHigherPrioritiesFirst(t *testing.T) {
+	var queue = newJobQueue(10)
+	queue.push(
+		item{counter: 1, submitter: "a", priority: 0},
+		item{counter: 2, submitter: "a", priority: 5},
+		item{counter: 3, submitter: "b", priority: 5},
+		item{counter: 4, submitter: "b", priority: 9},
+	)
+	var expected = []int{4, 2, 3, 1}
+	if positions := queue.positions(); positions[4] != 1 || positions[1] != 4 {
+		t.Fatalf("unexpected positions %v", positions)
+	}
+	if popped := popCounters(queue, 4); !reflect.DeepEqual(popped, expected) {
+		t.Fatalf("expected %v, got %v", expected, popped)
+	}
+}
+
+func TestQueueRemembersWhoWasServed(t *testing.T) {
+	var queue = newJobQueue(10)
+	queue.push(item{counter: 1, submitter: "a"})
+	popCounters(queue, 1)
+	queue.push(item{counter: 2, submitter: "a"}, item{counter: 3, submitter: "b"})
+	if popped := popCounters(queue, 2); !reflect.DeepEqual(popped, []int{3, 2}) {
+		t.Fatalf("a submitter that was just served should wait, got %v", popped)
+	}
+}
+
+func TestQueueCapacityAndRemoval(t *testing.T) {
+	var queue = newJobQueue(2)
+	if err := queue.push(item{counter: 1}, item{counter: 2}, item{counter: 3}); !errors.Is(err, errQueueFull) {
+		t.Fatalf("expected errQueueFull, got %v", err)
+	}
+	if queue.available() != 2 {
+		t.Fatal("a refused push must not enqueue anything")
+	}
+	queue.push(item{counter: 1}, item{counter: 2})
+	if queue.available() != 0 || queue.push(item{counter: 3}) == nil {
+		t.Fatal("expected the queue to be full")
+	}
+	if !queue.remove(1) || queue.remove(1) || queue.available() != 1 {
+		t.Fatal("expected job 1 to be removed exactly once")
+	}
+	if positions := queue.positions(); len(positions) != 1 || positions[2] != 1 {
+		t.Fatalf("unexpected positions after removal %v", positions)
+	}
+}
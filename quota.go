@@ -0,0 +1,319 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	webserver "github.com/zhongjie-cai/web-server"
+)
+
+var errQuotaExceeded = errors.New("storage limit exceeded")
+
+var quotaLock sync.Mutex
+
+const QUOTA_PER_USER_NOTE string = "submitters are identified by their unauthenticated X-API-Key header or client address, so the per-user quota is advisory; the global quota is the enforced limit"
+
+type freeSpacer interface {
+	FreeSpace() (int64, error)
+}
+
+type objectSizer interface {
+	Sizes() (map[string]int64, error)
+	Reload()
+}
+
+type meteredStorage struct {
+	storage
+	lock   sync.Mutex
+	sizes  map[string]int64
+	loaded bool
+}
+
+func newMeteredStorage(store storage) *meteredStorage {
+	return &meteredStorage{
+		storage: store,
+		sizes:   map[string]int64{},
+	}
+}
+
+func (store *meteredStorage) record(name string, size int64) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	if store.loaded {
+		store.sizes[name] = size
+	}
+}
+
+func (store *meteredStorage) Put(name string, content []byte) error {
+	var putError = store.storage.Put(name, content)
+	if putError == nil {
+		store.record(name, int64(len(content)))
+	}
+	return putError
+}
+
+type meteredStorageWriter struct {
+	storageWriter
+	store *meteredStorage
+	name  string
+	size  int64
+}
+
+func (writer *meteredStorageWriter) Write(content []byte) (int, error) {
+	var written, writeError = writer.storageWriter.Write(content)
+	writer.size += int64(written)
+	return written, writeError
+}
+
+func (writer *meteredStorageWriter) Close() error {
+	var closeError = writer.storageWriter.Close()
+	if closeError == nil {
+		writer.store.record(writer.name, writer.size)
+	}
+	return closeError
+}
+
+func (store *meteredStorage) Create(name string) (storageWriter, error) {
+	var writer, writerError = store.storage.Create(name)
+	if writerError != nil {
+		return nil, writerError
+	}
+	return &meteredStorageWriter{
+		storageWriter: writer,
+		store:         store,
+		name:          name,
+	}, nil
+}
+
+func (store *meteredStorage) Delete(name string) error {
+	var deleteError = store.storage.Delete(name)
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	if deleteError == nil {
+		delete(store.sizes, name)
+	} else {
+		store.loaded = false
+	}
+	return deleteError
+}
+
+func (store *meteredStorage) Sizes() (map[string]int64, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	if !store.loaded {
+		var objects, objectsError = store.storage.List("")
+		if objectsError != nil {
+			return nil, objectsError
+		}
+		store.sizes = map[string]int64{}
+		for _, object := range objects {
+			store.sizes[object.Name] = object.Size
+		}
+		store.loaded = true
+	}
+	var sizes = make(map[string]int64, len(store.sizes))
+	for name, size := range store.sizes {
+		sizes[name] = size
+	}
+	return sizes, nil
+}
+
+func (store *meteredStorage) Reload() {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	store.loaded = false
+}
+
+func (store *meteredStorage) FreeSpace() (int64, error) {
+	var spacer, supported = store.storage.(freeSpacer)
+	if !supported {
+		return -1, nil
+	}
+	return spacer.FreeSpace()
+}
+
+func getObjectSizes() (map[string]int64, error) {
+	if sizer, metered := outputs.(objectSizer); metered {
+		return sizer.Sizes()
+	}
+	var objects, objectsError = outputs.List("")
+	if objectsError != nil {
+		return nil, objectsError
+	}
+	var sizes = map[string]int64{}
+	for _, object := range objects {
+		sizes[object.Name] = object.Size
+	}
+	return sizes, nil
+}
+
+type storageUsage struct {
+	Global    int64            `json:"global"`
+	Submitter map[string]int64 `json:"-"`
+}
+
+type quotaStatus struct {
+	Submitter   string `json:"submitter"`
+	Used        int64  `json:"used"`
+	Limit       int    `json:"limit,omitempty"`
+	Note        string `json:"note,omitempty"`
+	GlobalUsed  int64  `json:"global_used"`
+	GlobalLimit int    `json:"global_limit,omitempty"`
+	FreeSpace   *int64 `json:"free_space,omitempty"`
+	MinFree     int    `json:"min_free"`
+}
+
+func getJobObjectCounter(name string) (int, bool) {
+	var relative, found = strings.CutPrefix(name, appConfig.InputsDir+"/")
+	if !found {
+		relative, found = strings.CutPrefix(name, appConfig.ResultsDir+"/")
+	}
+	if !found {
+		return 0, false
+	}
+	var dir, _, _ = strings.Cut(relative, "/")
+	var counter, counterError = strconv.Atoi(dir)
+	return counter, counterError == nil
+}
+
+func getStorageUsage() (storageUsage, error) {
+	var usage = storageUsage{
+		Submitter: map[string]int64{},
+	}
+	var sizes, sizesError = getObjectSizes()
+	if sizesError != nil {
+		return usage, sizesError
+	}
+	var owners = map[string]string{}
+	var counterOwners = map[int]string{}
+	for _, entry := range jobs.List() {
+		if entry.File != "" {
+			owners[entry.File] = entry.Submitter
+		}
+		counterOwners[entry.Counter] = entry.Submitter
+		if entry.FinishedAt == nil {
+			usage.Global += entry.InputBytes
+			usage.Submitter[entry.Submitter] += entry.InputBytes
+		}
+	}
+	for name, size := range sizes {
+		var owner, found = owners[name]
+		if !found {
+			if counter, isJobObject := getJobObjectCounter(name); isJobObject {
+				owner, found = counterOwners[counter]
+			}
+		}
+		if !found {
+			continue
+		}
+		usage.Global += size
+		usage.Submitter[owner] += size
+	}
+	return usage, nil
+}
+
+func getFreeSpace() (int64, bool) {
+	var spacer, supported = outputs.(freeSpacer)
+	if !supported {
+		return 0, false
+	}
+	var free, freeError = spacer.FreeSpace()
+	if freeError != nil || free < 0 {
+		return 0, false
+	}
+	return free, true
+}
+
+func checkFreeSpace(needed int64) error {
+	var free, known = getFreeSpace()
+	if !known {
+		return nil
+	}
+	if free-needed < int64(appConfig.MinFreeBytes) {
+		return fmt.Errorf(
+			"%w: writing %d bytes would leave %d of the required %d free bytes on the output storage",
+			errQuotaExceeded,
+			needed,
+			free-needed,
+			appConfig.MinFreeBytes,
+		)
+	}
+	return nil
+}
+
+func getUploadFootprint(batchItems []item) int64 {
+	var size int64
+	for _, batchItem := range batchItems {
+		for _, target := range batchItem.targetImageBytes {
+			size += int64(len(target.bytes))
+		}
+	}
+	if appConfig.InputRetention > 0 {
+		return size * 2
+	}
+	return size
+}
+
+func checkStorageQuota(submitter string, needed int64) error {
+	if appConfig.QuotaPerUser > 0 || appConfig.QuotaGlobal > 0 {
+		var usage, usageError = getStorageUsage()
+		if usageError != nil {
+			return usageError
+		}
+		if appConfig.QuotaPerUser > 0 && usage.Submitter[submitter]+needed > int64(appConfig.QuotaPerUser) {
+			return fmt.Errorf(
+				"%w: %s already uses %d of %d bytes and this upload needs about %d more",
+				errQuotaExceeded,
+				submitter,
+				usage.Submitter[submitter],
+				appConfig.QuotaPerUser,
+				needed,
+			)
+		}
+		if appConfig.QuotaGlobal > 0 && usage.Global+needed > int64(appConfig.QuotaGlobal) {
+			return fmt.Errorf(
+				"%w: the service already uses %d of %d bytes and this upload needs about %d more",
+				errQuotaExceeded,
+				usage.Global,
+				appConfig.QuotaGlobal,
+				needed,
+			)
+		}
+	}
+	return checkFreeSpace(needed)
+}
+
+func writeQuotaExceededResponse(session webserver.Session, quotaError error) (interface{}, error) {
+	return writeJSONResponse(
+		session.GetResponseWriter(),
+		http.StatusInsufficientStorage,
+		webserver.GetInvalidOperation(quotaError.Error()),
+	)
+}
+
+func getQuotaAction(session webserver.Session) (interface{}, error) {
+	var submitter = getSubmitter(session.GetRequest())
+	var usage, usageError = getStorageUsage()
+	if usageError != nil {
+		return nil, usageError
+	}
+	var status = quotaStatus{
+		Submitter:   submitter,
+		Used:        usage.Submitter[submitter],
+		Limit:       appConfig.QuotaPerUser,
+		GlobalUsed:  usage.Global,
+		GlobalLimit: appConfig.QuotaGlobal,
+		MinFree:     appConfig.MinFreeBytes,
+	}
+	if appConfig.QuotaPerUser > 0 {
+		status.Note = QUOTA_PER_USER_NOTE
+	}
+	if free, known := getFreeSpace(); known {
+		status.FreeSpace = &free
+	}
+	return status, nil
+}
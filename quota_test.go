@@ -0,0 +1,167 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestStorageUsageCountsOnlyJobObjects(t *testing.T) {
+	var root = useTestStorage(t)
+	var finishedAt = time.Now()
+	var counter, _ = jobs.Create(&job{
+		Submitter:  "ip:1",
+		File:       "a.cache.zip",
+		FinishedAt: &finishedAt,
+	})
+	var running, _ = jobs.Create(&job{
+		Submitter:  "ip:2",
+		InputBytes: 50,
+	})
+	outputs.Put("a.cache.zip", make([]byte, 100))
+	outputs.Put(getStorageName(getInputsDir(counter), "0000_a.png"), make([]byte, 10))
+	outputs.Put(getResultName(running, 0, "b.jpg"), make([]byte, 20))
+	outputs.Put(getStorageName(getInputsDir(99), "0000_c.png"), make([]byte, 1000))
+	outputs.Put("unrelated.bin", make([]byte, 1000))
+	os.WriteFile(filepath.Join(root, JOB_STORE_FILE), make([]byte, 1000), 0644)
+	var usage, err = getStorageUsage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usage.Submitter["ip:1"] != 110 || usage.Submitter["ip:2"] != 70 || usage.Global != 180 {
+		t.Fatalf("unexpected usage %+v", usage)
+	}
+}
+
+type listCountingStorage struct {
+	storage
+	lists *int
+}
+
+func (store listCountingStorage) List(prefix string) ([]storageObject, error) {
+	*store.lists++
+	return store.storage.List(prefix)
+}
+
+func TestMeteredStorageKeepsARunningUsage(t *testing.T) {
+	var root = useTestStorage(t)
+	var lists = 0
+	var inner, _ = newLocalStorage(root)
+	outputs = newMeteredStorage(listCountingStorage{inner, &lists})
+	var finishedAt = time.Now()
+	jobs.Create(&job{
+		Submitter:  "ip:1",
+		File:       "a.cache.zip",
+		FinishedAt: &finishedAt,
+	})
+	outputs.Put("a.cache.zip", make([]byte, 100))
+	var usage, _ = getStorageUsage()
+	if usage.Global != 100 || lists != 1 {
+		t.Fatalf("expected the first usage to list once, got %+v after %d lists", usage, lists)
+	}
+	var writer, _ = outputs.Create("a.cache.zip")
+	writer.Write(make([]byte, 40))
+	writer.Close()
+	usage, _ = getStorageUsage()
+	if usage.Global != 40 || lists != 1 {
+		t.Fatalf("expected a rewritten archive to be tracked, got %+v after %d lists", usage, lists)
+	}
+	outputs.Delete("a.cache.zip")
+	usage, _ = getStorageUsage()
+	if usage.Global != 0 || lists != 1 {
+		t.Fatalf("expected a deleted archive to be tracked, got %+v after %d lists", usage, lists)
+	}
+	os.WriteFile(filepath.Join(root, "a.cache.zip"), make([]byte, 7), 0644)
+	outputs.(objectSizer).Reload()
+	usage, _ = getStorageUsage()
+	if usage.Global != 7 || lists != 2 {
+		t.Fatalf("expected a reload to pick up external changes, got %+v after %d lists", usage, lists)
+	}
+}
+
+func TestPerUserQuotaNeedsAGlobalQuota(t *testing.T) {
+	var settings = appConfig
+	settings.QuotaPerUser = 100
+	settings.QuotaGlobal = 0
+	if err := settings.validate(); err == nil {
+		t.Fatal("an advisory per-user quota alone must be rejected")
+	}
+	settings.QuotaGlobal = 1000
+	if err := settings.validate(); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+}
+
+func TestStorageQuotaRejectsUploads(t *testing.T) {
+	useTestStorage(t)
+	appConfig.MinFreeBytes = 0
+	appConfig.QuotaPerUser = 100
+	jobs.Create(&job{
+		Submitter:  "ip:1",
+		InputBytes: 80,
+	})
+	if err := checkStorageQuota("ip:1", 30); !errors.Is(err, errQuotaExceeded) {
+		t.Fatalf("expected the per-user quota to be exceeded, got %v", err)
+	}
+	if err := checkStorageQuota("ip:2", 30); err != nil {
+		t.Fatalf("other submitters must not be affected, got %v", err)
+	}
+	appConfig.QuotaGlobal = 100
+	if err := checkStorageQuota("ip:2", 30); !errors.Is(err, errQuotaExceeded) {
+		t.Fatalf("expected the global quota to be exceeded, got %v", err)
+	}
+}
+
+func TestStorageQuotaSerializesConcurrentUploads(t *testing.T) {
+	useTestStorage(t)
+	appConfig.MinFreeBytes = 0
+	appConfig.QuotaGlobal = 1000
+	var waitGroup sync.WaitGroup
+	var lock sync.Mutex
+	var accepted = 0
+	for i := 0; i < 10; i++ {
+		waitGroup.Add(1)
+		go func() {
+			defer waitGroup.Done()
+			var _, err = submitBatches([]item{
+				{
+					imageProcessor: processors["mock"],
+					submitter:      "ip:1",
+					targetImageBytes: []imageBytes{
+						{name: "a.png", bytes: make([]byte, 300)},
+					},
+				},
+			})
+			if err == nil {
+				lock.Lock()
+				accepted++
+				lock.Unlock()
+			} else if !errors.Is(err, errQuotaExceeded) {
+				t.Errorf("unexpected error %v", err)
+			}
+		}()
+	}
+	waitGroup.Wait()
+	if accepted != 3 {
+		t.Fatalf("expected exactly 3 uploads of 300 bytes to fit into 1000, got %d", accepted)
+	}
+}
+
+func TestFreeSpaceGuard(t *testing.T) {
+	useTestStorage(t)
+	appConfig.MinFreeBytes = 0
+	if err := checkFreeSpace(1); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	var free, known = getFreeSpace()
+	if !known {
+		t.Skip("free space is not reported on this platform")
+	}
+	appConfig.MinFreeBytes = int(free)
+	if err := checkFreeSpace(1); !errors.Is(err, errQuotaExceeded) {
+		t.Fatalf("expected the free space guard to trip, got %v", err)
+	}
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	webserver "github.com/zhongjie-cai/web-server"
+)
+
+const THUMBNAIL_SIZE int = 256
+
+func getResultsDir(counter int) string {
+	return getStorageName(appConfig.ResultsDir, fmt.Sprintf("%04d", counter))
+}
+
+func getResultName(counter int, index int, output string) string {
+	return getStorageName(
+		getResultsDir(counter),
+		fmt.Sprintf("%04d_%s", index, getInputName(output)),
+	)
+}
+
+func getThumbnailName(counter int, index int) string {
+	return getStorageName(
+		getResultsDir(counter),
+		"thumbnails",
+		fmt.Sprintf("%04d.jpg", index),
+	)
+}
+
+func getResultURL(counter int, index int) string {
+	return fmt.Sprintf("/jobs/%d/images/%d", counter, index)
+}
+
+func getThumbnailURL(counter int, index int) string {
+	return fmt.Sprint(getResultURL(counter, index), "/thumbnail")
+}
+
+func createThumbnail(imageBytes []byte) ([]byte, error) {
+	var decodedImage, _, decodeErr = image.Decode(bytes.NewReader(imageBytes))
+	if decodeErr != nil {
+		return nil, decodeErr
+	}
+	var bounds = decodedImage.Bounds()
+	var width, height = bounds.Dx(), bounds.Dy()
+	if width > THUMBNAIL_SIZE || height > THUMBNAIL_SIZE {
+		if width >= height {
+			width, height = THUMBNAIL_SIZE, max(1, height*THUMBNAIL_SIZE/bounds.Dx())
+		} else {
+			width, height = max(1, width*THUMBNAIL_SIZE/bounds.Dy()), THUMBNAIL_SIZE
+		}
+	}
+	var thumbnail = image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		var top = bounds.Min.Y + y*bounds.Dy()/height
+		var bottom = max(top+1, bounds.Min.Y+(y+1)*bounds.Dy()/height)
+		for x := 0; x < width; x++ {
+			var left = bounds.Min.X + x*bounds.Dx()/width
+			var right = max(left+1, bounds.Min.X+(x+1)*bounds.Dx()/width)
+			var r, g, b, a, count uint32
+			for sourceY := top; sourceY < bottom; sourceY++ {
+				for sourceX := left; sourceX < right; sourceX++ {
+					var pixelR, pixelG, pixelB, pixelA = decodedImage.At(sourceX, sourceY).RGBA()
+					r, g, b, a = r+pixelR, g+pixelG, b+pixelB, a+pixelA
+					count++
+				}
+			}
+			thumbnail.Set(x, y, color.RGBA64{
+				R: uint16(r / count),
+				G: uint16(g / count),
+				B: uint16(b / count),
+				A: uint16(a / count),
+			})
+		}
+	}
+	var buffer bytes.Buffer
+	var jpegErr = jpeg.Encode(
+		&buffer,
+		thumbnail,
+		&jpeg.Options{
+			Quality: 80,
+		},
+	)
+	if jpegErr != nil {
+		return nil, jpegErr
+	}
+	return buffer.Bytes(), nil
+}
+
+func saveJobResult(counter int, index int, result imageBytes, outcome *imageOutcome) error {
+	var thumbnailBytes, thumbnailError = createThumbnail(result.bytes)
+	if thumbnailError != nil {
+		return thumbnailError
+	}
+	var spaceError = checkFreeSpace(int64(len(result.bytes) + len(thumbnailBytes)))
+	if spaceError != nil {
+		return spaceError
+	}
+	var resultError = outputs.Put(
+		getResultName(counter, index, result.name),
+		result.bytes,
+	)
+	if resultError != nil {
+		return resultError
+	}
+	outcome.DownloadURL = getResultURL(counter, index)
+	thumbnailError = outputs.Put(
+		getThumbnailName(counter, index),
+		thumbnailBytes,
+	)
+	if thumbnailError != nil {
+		return thumbnailError
+	}
+	outcome.ThumbnailURL = getThumbnailURL(counter, index)
+	return nil
+}
+
+func deleteJobResults(counter int) error {
+	var entries, entriesError = outputs.List(getResultsDir(counter) + "/")
+	if entriesError != nil {
+		return entriesError
+	}
+	for _, entry := range entries {
+		var deleteError = outputs.Delete(entry.Name)
+		if deleteError != nil {
+			return deleteError
+		}
+	}
+	return nil
+}
+
+func deleteArchivedResults(counter int) error {
+	var entries, entriesError = outputs.List(getResultsDir(counter) + "/")
+	if entriesError != nil {
+		return entriesError
+	}
+	var thumbnailsDir = getStorageName(getResultsDir(counter), "thumbnails") + "/"
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name, thumbnailsDir) {
+			continue
+		}
+		var deleteError = outputs.Delete(entry.Name)
+		if deleteError != nil {
+			return deleteError
+		}
+	}
+	return nil
+}
+
+type storageReaderAt struct {
+	lock   sync.Mutex
+	reader storageReader
+}
+
+func (readerAt *storageReaderAt) ReadAt(content []byte, offset int64) (int, error) {
+	readerAt.lock.Lock()
+	defer readerAt.lock.Unlock()
+	var _, seekError = readerAt.reader.Seek(offset, io.SeekStart)
+	if seekError != nil {
+		return 0, seekError
+	}
+	var read, readError = io.ReadFull(readerAt.reader, content)
+	if errors.Is(readError, io.ErrUnexpectedEOF) {
+		readError = io.EOF
+	}
+	return read, readError
+}
+
+func (readerAt *storageReaderAt) Close() error {
+	return readerAt.reader.Close()
+}
+
+func openStorageArchive(archiveName string) (*zip.Reader, *storageReaderAt, error) {
+	var object, objectError = outputs.Stat(archiveName)
+	if objectError != nil {
+		return nil, nil, objectError
+	}
+	var content, contentError = outputs.Open(archiveName)
+	if contentError != nil {
+		return nil, nil, contentError
+	}
+	var readerAt = &storageReaderAt{
+		reader: content,
+	}
+	var archive, archiveError = zip.NewReader(readerAt, object.Size)
+	if archiveError != nil {
+		content.Close()
+		return nil, nil, archiveError
+	}
+	return archive, readerAt, nil
+}
+
+func serveArchiveEntry(session webserver.Session, archiveName string, entryName string) error {
+	var archive, readerAt, archiveError = openStorageArchive(archiveName)
+	if archiveError != nil {
+		return archiveError
+	}
+	defer readerAt.Close()
+	for _, file := range archive.File {
+		if file.Name != entryName || file.Method != zip.Store {
+			continue
+		}
+		var offset, offsetError = file.DataOffset()
+		if offsetError != nil {
+			return offsetError
+		}
+		var responseWriter = session.GetResponseWriter()
+		setAttachmentHeaders(responseWriter, entryName)
+		http.ServeContent(
+			responseWriter,
+			session.GetRequest(),
+			entryName,
+			file.Modified,
+			io.NewSectionReader(readerAt, offset, int64(file.UncompressedSize64)),
+		)
+		return nil
+	}
+	return os.ErrNotExist
+}
+
+func getJobResult(session webserver.Session) (*job, int, imageOutcome, error) {
+	var job, jobError = getJobFromSession(session)
+	if jobError != nil {
+		return nil, 0, imageOutcome{}, jobError
+	}
+	var index int
+	var indexError = session.GetRequestParameter(
+		"index",
+		&index,
+	)
+	if indexError != nil {
+		return nil, 0, imageOutcome{}, indexError
+	}
+	if index < 0 || index >= len(job.Images) {
+		return nil, 0, imageOutcome{}, webserver.GetNotFound(
+			fmt.Sprintf("job %d has no image %d", job.Counter, index),
+		)
+	}
+	var outcome = job.Images[index]
+	if outcome.DownloadURL == "" {
+		return nil, 0, imageOutcome{}, webserver.GetNotFound(
+			fmt.Sprintf("image %d of job %d has no result yet", index, job.Counter),
+		)
+	}
+	return job, index, outcome, nil
+}
+
+func getJobImageAction(session webserver.Session) (interface{}, error) {
+	var job, index, outcome, resultError = getJobResult(session)
+	if resultError != nil {
+		return nil, resultError
+	}
+	if strings.HasSuffix(job.File, ".cache.zip") {
+		var archiveError = serveArchiveEntry(
+			session,
+			job.File,
+			outcome.Output,
+		)
+		if archiveError == nil {
+			return webserver.SkipResponseHandling()
+		}
+		if !errors.Is(archiveError, os.ErrNotExist) {
+			return nil, archiveError
+		}
+	}
+	var _, _, serveError = serveOutput(
+		session,
+		getResultName(job.Counter, index, outcome.Output),
+		outcome.Output,
+	)
+	if serveError != nil {
+		return nil, serveError
+	}
+	return webserver.SkipResponseHandling()
+}
+
+func getJobThumbnailAction(session webserver.Session) (interface{}, error) {
+	var job, index, outcome, resultError = getJobResult(session)
+	if resultError != nil {
+		return nil, resultError
+	}
+	if outcome.ThumbnailURL == "" {
+		return nil, webserver.GetNotFound(
+			fmt.Sprintf("image %d of job %d has no thumbnail", index, job.Counter),
+		)
+	}
+	var _, _, serveError = serveOutput(
+		session,
+		getThumbnailName(job.Counter, index),
+		"",
+	)
+	if serveError != nil {
+		return nil, serveError
+	}
+	return webserver.SkipResponseHandling()
+}
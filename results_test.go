@@ -0,0 +1,48 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestSaveJobResultChecksFreeSpace(t *testing.T) {
+	useTestStorage(t)
+	exhaustFreeSpace(t)
+	var outcome imageOutcome
+	var err = saveJobResult(
+		1,
+		0,
+		imageBytes{name: "a.jpg", bytes: getTestPNG(t)},
+		&outcome,
+	)
+	if !errors.Is(err, errQuotaExceeded) {
+		t.Fatalf("expected the free space guard to trip, got %v", err)
+	}
+	var objects, _ = outputs.List(getResultsDir(1) + "/")
+	if len(objects) != 0 || outcome.DownloadURL != "" {
+		t.Fatalf("nothing should be stored, got %v %+v", getObjectNames(objects), outcome)
+	}
+}
+
+func TestDeleteArchivedResultsKeepsThumbnails(t *testing.T) {
+	useTestStorage(t)
+	var outcome imageOutcome
+	var err = saveJobResult(
+		1,
+		0,
+		imageBytes{name: "a.jpg", bytes: getTestPNG(t)},
+		&outcome,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if outcome.DownloadURL != getResultURL(1, 0) || outcome.ThumbnailURL != getThumbnailURL(1, 0) {
+		t.Fatalf("unexpected outcome %+v", outcome)
+	}
+	deleteArchivedResults(1)
+	var objects, _ = outputs.List(getResultsDir(1) + "/")
+	var names = getObjectNames(objects)
+	if len(names) != 1 || names[0] != getThumbnailName(1, 0) {
+		t.Fatalf("only the thumbnail should remain, got %v", names)
+	}
+}
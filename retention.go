@@ -0,0 +1,150 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	webserver "github.com/zhongjie-cai/web-server"
+)
+
+type retentionCandidate struct {
+	Counter    int       `json:"counter"`
+	File       string    `json:"file"`
+	Size       int64     `json:"size"`
+	FinishedAt time.Time `json:"finished_at"`
+	Reason     string    `json:"reason"`
+}
+
+type retentionPlan struct {
+	Enabled    bool                 `json:"enabled"`
+	TotalSize  int64                `json:"total_size"`
+	TotalCount int                  `json:"total_count"`
+	NextRunAt  *time.Time           `json:"next_run_at,omitempty"`
+	Purge      []retentionCandidate `json:"purge"`
+}
+
+var nextJanitorRun atomic.Pointer[time.Time]
+
+func isRetentionEnabled() bool {
+	return appConfig.RetentionAge > 0 ||
+		appConfig.RetentionMaxBytes > 0 ||
+		appConfig.RetentionMaxCount > 0
+}
+
+func getRetentionPlan(now time.Time) (retentionPlan, error) {
+	var plan = retentionPlan{
+		Enabled:   isRetentionEnabled(),
+		NextRunAt: nextJanitorRun.Load(),
+		Purge:     []retentionCandidate{},
+	}
+	var objects, objectsError = outputs.List("")
+	if objectsError != nil {
+		return plan, objectsError
+	}
+	var sizes = map[string]int64{}
+	for _, object := range objects {
+		sizes[object.Name] = object.Size
+	}
+	var candidates = []retentionCandidate{}
+	for _, entry := range jobs.List() {
+		if entry.FinishedAt == nil {
+			continue
+		}
+		candidates = append(candidates, retentionCandidate{
+			Counter:    entry.Counter,
+			File:       entry.File,
+			Size:       sizes[entry.File],
+			FinishedAt: *entry.FinishedAt,
+		})
+	}
+	sort.Slice(
+		candidates,
+		func(i, j int) bool {
+			return candidates[i].FinishedAt.After(candidates[j].FinishedAt)
+		},
+	)
+	for index, candidate := range candidates {
+		plan.TotalCount++
+		plan.TotalSize += candidate.Size
+		if appConfig.RetentionAge > 0 && now.Sub(candidate.FinishedAt) > appConfig.RetentionAge {
+			candidate.Reason = "age"
+		} else if appConfig.RetentionMaxCount > 0 && index >= appConfig.RetentionMaxCount {
+			candidate.Reason = "count"
+		} else if appConfig.RetentionMaxBytes > 0 && plan.TotalSize > int64(appConfig.RetentionMaxBytes) {
+			candidate.Reason = "size"
+		}
+		if candidate.Reason != "" {
+			plan.Purge = append(plan.Purge, candidate)
+		}
+	}
+	return plan, nil
+}
+
+func purgeExpiredOutputs() {
+	if !isRetentionEnabled() {
+		return
+	}
+	var plan, planError = getRetentionPlan(time.Now())
+	if planError != nil {
+		return
+	}
+	var owners = map[string]int{}
+	for _, entry := range jobs.List() {
+		if entry.File != "" {
+			owners[entry.File]++
+		}
+	}
+	for _, candidate := range plan.Purge {
+		if candidate.File != "" && owners[candidate.File] == 1 {
+			var deleteError = outputs.Delete(candidate.File)
+			if deleteError != nil {
+				continue
+			}
+		}
+		owners[candidate.File]--
+		deleteJobInputs(candidate.Counter)
+		deleteJobResults(candidate.Counter)
+		jobs.Delete(candidate.Counter)
+	}
+}
+
+func purgeMissingOutputs() {
+	for _, entry := range jobs.List() {
+		if entry.File == "" || entry.FinishedAt == nil {
+			continue
+		}
+		var _, statError = outputs.Stat(entry.File)
+		if errors.Is(statError, os.ErrNotExist) {
+			deleteJobInputs(entry.Counter)
+			deleteJobResults(entry.Counter)
+			jobs.Delete(entry.Counter)
+		}
+	}
+}
+
+func doCleaning() {
+	var ticker = time.NewTicker(appConfig.JanitorInterval)
+	defer ticker.Stop()
+	for {
+		purgeExpiredInputs()
+		purgeExpiredOutputs()
+		purgeMissingOutputs()
+		if sizer, metered := outputs.(objectSizer); metered {
+			sizer.Reload()
+		}
+		var nextRunAt = time.Now().Add(appConfig.JanitorInterval)
+		nextJanitorRun.Store(&nextRunAt)
+		select {
+		case <-appContext.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func getRetentionAction(session webserver.Session) (interface{}, error) {
+	return getRetentionPlan(time.Now())
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func createFinishedJobs(t *testing.T, now time.Time, ages ...time.Duration) []int {
+	var counters = []int{}
+	for index, age := range ages {
+		var file = fmt.Sprintf("job%v.cache.zip", index)
+		var finishedAt = now.Add(-age)
+		var counter, err = jobs.Create(&job{
+			File:       file,
+			FinishedAt: &finishedAt,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		outputs.Put(file, make([]byte, 100))
+		counters = append(counters, counter)
+	}
+	return counters
+}
+
+func getPurgeReasons(t *testing.T, now time.Time) map[int]string {
+	var plan, err = getRetentionPlan(now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var reasons = map[int]string{}
+	for _, candidate := range plan.Purge {
+		reasons[candidate.Counter] = candidate.Reason
+	}
+	return reasons
+}
+
+func TestRetentionPlan(t *testing.T) {
+	useTestStorage(t)
+	var now = time.Now()
+	var counters = createFinishedJobs(t, now, time.Hour, 2*time.Hour, 3*time.Hour, 4*time.Hour)
+	if reasons := getPurgeReasons(t, now); len(reasons) != 0 {
+		t.Fatalf("nothing should be purged without a policy, got %v", reasons)
+	}
+	appConfig.RetentionAge = 150 * time.Minute
+	var reasons = getPurgeReasons(t, now)
+	if len(reasons) != 2 || reasons[counters[2]] != "age" || reasons[counters[3]] != "age" {
+		t.Fatalf("unexpected age purge %v", reasons)
+	}
+	appConfig.RetentionAge = 0
+	appConfig.RetentionMaxCount = 1
+	reasons = getPurgeReasons(t, now)
+	if len(reasons) != 3 || reasons[counters[0]] != "" || reasons[counters[1]] != "count" {
+		t.Fatalf("unexpected count purge %v", reasons)
+	}
+	appConfig.RetentionMaxCount = 0
+	appConfig.RetentionMaxBytes = 250
+	reasons = getPurgeReasons(t, now)
+	if len(reasons) != 2 || reasons[counters[2]] != "size" || reasons[counters[3]] != "size" {
+		t.Fatalf("unexpected size purge %v", reasons)
+	}
+}
+
+func TestPurgeExpiredOutputs(t *testing.T) {
+	useTestStorage(t)
+	var now = time.Now()
+	var counters = createFinishedJobs(t, now, time.Minute, 48*time.Hour)
+	outputs.Put(getResultName(counters[1], 0, "a.jpg"), []byte("result"))
+	appConfig.RetentionAge = 24 * time.Hour
+	purgeExpiredOutputs()
+	if _, found := jobs.Get(counters[1]); found {
+		t.Fatal("expired job should be deleted")
+	}
+	if _, err := outputs.Stat("job1.cache.zip"); err == nil {
+		t.Fatal("expired archive should be deleted")
+	}
+	var objects, _ = outputs.List(getResultsDir(counters[1]))
+	if len(objects) != 0 {
+		t.Fatalf("expired results should be deleted, got %v", objects)
+	}
+	if _, found := jobs.Get(counters[0]); !found {
+		t.Fatal("recent job should be kept")
+	}
+	if _, err := outputs.Stat("job0.cache.zip"); err != nil {
+		t.Fatalf("recent archive should be kept, got %v", err)
+	}
+}
+
+func TestPurgeJobsWithoutFiles(t *testing.T) {
+	useTestStorage(t)
+	var now = time.Now()
+	var finishedAt = now.Add(-48 * time.Hour)
+	var canceled, _ = jobs.Create(&job{
+		State:      JOB_STATE_CANCELED,
+		FinishedAt: &finishedAt,
+	})
+	appConfig.RetentionAge = 24 * time.Hour
+	purgeExpiredOutputs()
+	if _, found := jobs.Get(canceled); found {
+		t.Fatal("expired jobs without a file should be purged")
+	}
+}
+
+func TestPurgeKeepsFilesOfOtherJobs(t *testing.T) {
+	useTestStorage(t)
+	var now = time.Now()
+	var expiredAt = now.Add(-48 * time.Hour)
+	var expired, _ = jobs.Create(&job{
+		File:       "shared.error.log",
+		FinishedAt: &expiredAt,
+	})
+	jobs.Create(&job{
+		File:       "shared.error.log",
+		FinishedAt: &now,
+	})
+	outputs.Put("shared.error.log", []byte("failure"))
+	appConfig.RetentionAge = 24 * time.Hour
+	purgeExpiredOutputs()
+	if _, found := jobs.Get(expired); found {
+		t.Fatal("expired job should be purged")
+	}
+	if _, err := outputs.Stat("shared.error.log"); err != nil {
+		t.Fatalf("a file still used by another job must be kept, got %v", err)
+	}
+}
+
+func TestPurgeMissingOutputs(t *testing.T) {
+	useTestStorage(t)
+	var now = time.Now()
+	var counters = createFinishedJobs(t, now, time.Minute, time.Minute)
+	outputs.Delete("job1.cache.zip")
+	purgeMissingOutputs()
+	if _, found := jobs.Get(counters[1]); found {
+		t.Fatal("jobs whose archive is gone should be forgotten")
+	}
+	if _, found := jobs.Get(counters[0]); !found {
+		t.Fatal("jobs whose archive exists should be kept")
+	}
+}
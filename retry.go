@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"time"
+)
+
+type reactorStatusError struct {
+	StatusCode int
+	Status     string
+}
+
+func (statusError *reactorStatusError) Error() string {
+	return fmt.Sprintf("wrong response [%d]: {%s}", statusError.StatusCode, statusError.Status)
+}
+
+type imageAttempt struct {
+	Attempt    int       `json:"attempt"`
+	StatusCode int       `json:"status_code,omitempty"`
+	Backend    string    `json:"backend,omitempty"`
+	Error      string    `json:"error"`
+	FailedAt   time.Time `json:"failed_at"`
+	RetryIn    string    `json:"retry_in,omitempty"`
+}
+
+func postReactor(
+	ctx context.Context,
+	reactorAPI string,
+	contentType string,
+	content []byte,
+) ([]byte, error) {
+	var request, requestError = http.NewRequestWithContext(
+		ctx,
+		http.MethodPost,
+		reactorAPI,
+		bytes.NewReader(content),
+	)
+	if requestError != nil {
+		return nil, requestError
+	}
+	request.Header.Set("Content-Type", contentType)
+	var response, responseError = http.DefaultClient.Do(request)
+	if responseError != nil {
+		return nil, responseError
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, &reactorStatusError{
+			StatusCode: response.StatusCode,
+			Status:     response.Status,
+		}
+	}
+	var buffer = &bytes.Buffer{}
+	var _, bufferError = buffer.ReadFrom(response.Body)
+	if bufferError != nil {
+		return nil, bufferError
+	}
+	return buffer.Bytes(), nil
+}
+
+func getRetryStatusCode(err error) int {
+	var statusError *reactorStatusError
+	if errors.As(err, &statusError) {
+		return statusError.StatusCode
+	}
+	return 0
+}
+
+func getRetryDelay(retry int) time.Duration {
+	var delay = appConfig.RetryBaseDelay
+	for i := 1; i < retry && delay < appConfig.RetryMaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > appConfig.RetryMaxDelay {
+		delay = appConfig.RetryMaxDelay
+	}
+	if delay <= 0 {
+		return 0
+	}
+	var half = delay / 2
+	return half + rand.N(half+1)
+}
+
+func postReactorWithRetry(
+	ctx context.Context,
+	reactorAPI string,
+	contentType string,
+	content []byte,
+) ([]byte, []imageAttempt, error) {
+	var attempts = []imageAttempt{}
+	var remaining = map[int]int{}
+	for statusCode, count := range appConfig.RetryStatuses {
+		remaining[statusCode] = count
+	}
+	var tried = map[string]bool{}
+	var retries = 0
+	for attempt := 1; ; attempt++ {
+		var target, finish, targetError = resolveBackend(ctx, reactorAPI, tried)
+		if targetError != nil {
+			return nil, attempts, targetError
+		}
+		var result, resultError = postReactor(ctx, target, contentType, content)
+		finish(resultError)
+		if resultError == nil || ctx.Err() != nil {
+			return result, attempts, resultError
+		}
+		var statusCode = getRetryStatusCode(resultError)
+		var failed = imageAttempt{
+			Attempt:    attempt,
+			StatusCode: statusCode,
+			Error:      resultError.Error(),
+			FailedAt:   time.Now(),
+		}
+		if reactorAPI == BACKEND_POOL {
+			failed.Backend = target
+			tried[target] = true
+			if backends.hasUntried(tried) {
+				failed.RetryIn = "failover"
+				attempts = append(attempts, failed)
+				continue
+			}
+			tried = map[string]bool{}
+		}
+		if remaining[statusCode] <= 0 || retries >= appConfig.RetryCount {
+			attempts = append(attempts, failed)
+			return nil, attempts, resultError
+		}
+		remaining[statusCode]--
+		retries++
+		var delay = getRetryDelay(retries)
+		failed.RetryIn = delay.String()
+		attempts = append(attempts, failed)
+		var slot = getEndpointSlot(ctx)
+		slot.release()
+		var timer = time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, attempts, ctx.Err()
+		case <-timer.C:
+		}
+		var slotError = slot.reacquire(ctx)
+		if slotError != nil {
+			return nil, attempts, slotError
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func startStatusBackend(t *testing.T, statusCode int, calls *atomic.Int32) string {
+	var server = httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		calls.Add(1)
+		response.WriteHeader(statusCode)
+		response.Write([]byte("{}"))
+	}))
+	t.Cleanup(server.Close)
+	return server.URL
+}
+
+func useTestRetries(t *testing.T) {
+	var savedConfig, savedBackends = appConfig, backends
+	t.Cleanup(func() {
+		appConfig, backends = savedConfig, savedBackends
+	})
+	appConfig.RetryBaseDelay = time.Millisecond
+	appConfig.RetryMaxDelay = time.Millisecond
+	appConfig.RetryCount = 2
+	appConfig.RetryStatuses = map[int]int{http.StatusServiceUnavailable: 2}
+}
+
+func TestRetryDelayGrowsWithRetries(t *testing.T) {
+	var saved = appConfig
+	defer func() { appConfig = saved }()
+	appConfig.RetryBaseDelay = 100 * time.Millisecond
+	appConfig.RetryMaxDelay = time.Second
+	for retry, maximum := range map[int]time.Duration{
+		1: 100 * time.Millisecond,
+		2: 200 * time.Millisecond,
+		3: 400 * time.Millisecond,
+		9: time.Second,
+	} {
+		var delay = getRetryDelay(retry)
+		if delay < maximum/2 || delay > maximum {
+			t.Errorf("retry %d: delay %v outside [%v, %v]", retry, delay, maximum/2, maximum)
+		}
+	}
+}
+
+func TestRetryStopsOnNonRetryableStatus(t *testing.T) {
+	useTestRetries(t)
+	var calls atomic.Int32
+	var address = startStatusBackend(t, http.StatusBadRequest, &calls)
+	var _, attempts, err = postReactorWithRetry(context.Background(), address, "application/json", nil)
+	if err == nil || calls.Load() != 1 || len(attempts) != 1 || attempts[0].StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected a single failed attempt, got %d calls %+v %v", calls.Load(), attempts, err)
+	}
+}
+
+func TestRetryHonoursTheStatusBudget(t *testing.T) {
+	useTestRetries(t)
+	var calls atomic.Int32
+	var address = startStatusBackend(t, http.StatusServiceUnavailable, &calls)
+	var _, attempts, err = postReactorWithRetry(context.Background(), address, "application/json", nil)
+	if err == nil || calls.Load() != 3 || len(attempts) != 3 || attempts[2].RetryIn != "" {
+		t.Fatalf("expected two retries, got %d calls %+v %v", calls.Load(), attempts, err)
+	}
+}
+
+func TestPoolFailsOverOnAnyBackendError(t *testing.T) {
+	useTestRetries(t)
+	var failedCalls, healthyCalls atomic.Int32
+	var failing = startStatusBackend(t, http.StatusBadRequest, &failedCalls)
+	var healthy = startStatusBackend(t, http.StatusOK, &healthyCalls)
+	backends = newBackendPool(map[string]int{failing: 1000, healthy: 1})
+	var result, attempts, err = postReactorWithRetry(context.Background(), BACKEND_POOL, "application/json", nil)
+	if err != nil || string(result) != "{}" || healthyCalls.Load() != 1 {
+		t.Fatalf("expected the healthy backend to answer, got %q %+v %v", result, attempts, err)
+	}
+	if len(attempts) != 1 || attempts[0].Backend != failing || attempts[0].RetryIn != "failover" {
+		t.Fatalf("expected a single failover from the failing backend, got %+v", attempts)
+	}
+}
+
+func TestPoolFailoverDoesNotSpendRetries(t *testing.T) {
+	useTestRetries(t)
+	appConfig.RetryCount = 0
+	var firstCalls, secondCalls atomic.Int32
+	var first = startStatusBackend(t, http.StatusServiceUnavailable, &firstCalls)
+	var second = startStatusBackend(t, http.StatusServiceUnavailable, &secondCalls)
+	backends = newBackendPool(map[string]int{first: 1, second: 1})
+	var _, attempts, err = postReactorWithRetry(context.Background(), BACKEND_POOL, "application/json", nil)
+	if err == nil || firstCalls.Load() != 1 || secondCalls.Load() != 1 || len(attempts) != 2 {
+		t.Fatalf("expected each backend to be tried once, got %d/%d %+v %v", firstCalls.Load(), secondCalls.Load(), attempts, err)
+	}
+}
@@ -0,0 +1,502 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	webserver "github.com/zhongjie-cai/web-server"
+)
+
+const S3_UPLOAD_PATTERN string = "s3-upload-*"
+
+const S3_STAGING_DIR string = ".s3-staging"
+
+type s3Storage struct {
+	endpoint  *url.URL
+	region    string
+	bucket    string
+	prefix    string
+	accessKey string
+	secretKey string
+	pathStyle bool
+	staging   string
+	client    *http.Client
+}
+
+type s3ListResult struct {
+	Contents []struct {
+		Key          string    `xml:"Key"`
+		Size         int64     `xml:"Size"`
+		LastModified time.Time `xml:"LastModified"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+func newS3Storage(
+	endpoint string,
+	region string,
+	bucket string,
+	prefix string,
+	accessKey string,
+	secretKey string,
+	pathStyle bool,
+	staging string,
+) (*s3Storage, error) {
+	var parsed, parseError = url.Parse(endpoint)
+	if parseError != nil {
+		return nil, parseError
+	}
+	var stagingError = removeStaleS3Uploads(staging)
+	if stagingError != nil {
+		return nil, stagingError
+	}
+	return &s3Storage{
+		endpoint:  parsed,
+		region:    region,
+		bucket:    bucket,
+		prefix:    strings.Trim(prefix, "/"),
+		accessKey: accessKey,
+		secretKey: secretKey,
+		pathStyle: pathStyle,
+		staging:   staging,
+		client: &http.Client{
+			Timeout: 5 * time.Minute,
+		},
+	}, nil
+}
+
+func removeStaleS3Uploads(staging string) error {
+	var mkdirError = os.MkdirAll(staging, 0700)
+	if mkdirError != nil {
+		return mkdirError
+	}
+	var staleFiles, staleFilesError = filepath.Glob(
+		filepath.Join(staging, S3_UPLOAD_PATTERN),
+	)
+	if staleFilesError != nil {
+		return staleFilesError
+	}
+	for _, staleFile := range staleFiles {
+		os.Remove(staleFile)
+	}
+	if len(staleFiles) > 0 {
+		logBackgroundLogic(
+			context.Background(),
+			webserver.LogLevelInfo,
+			"s3storage",
+			"removeStaleS3Uploads",
+			"Removed %d stale S3 upload staging files from %s",
+			len(staleFiles),
+			staging,
+		)
+	}
+	return nil
+}
+
+func encodeS3(value string, keepSlash bool) string {
+	var builder strings.Builder
+	for _, character := range []byte(value) {
+		if (character >= 'A' && character <= 'Z') ||
+			(character >= 'a' && character <= 'z') ||
+			(character >= '0' && character <= '9') ||
+			character == '-' || character == '.' || character == '_' || character == '~' ||
+			(keepSlash && character == '/') {
+			builder.WriteByte(character)
+		} else {
+			fmt.Fprintf(&builder, "%%%02X", character)
+		}
+	}
+	return builder.String()
+}
+
+func getSHA256Hex(content []byte) string {
+	var digest = sha256.Sum256(content)
+	return hex.EncodeToString(digest[:])
+}
+
+func getHMAC(key []byte, content string) []byte {
+	var mac = hmac.New(sha256.New, key)
+	mac.Write([]byte(content))
+	return mac.Sum(nil)
+}
+
+func (store *s3Storage) getKey(name string) string {
+	if store.prefix == "" {
+		return name
+	}
+	return store.prefix + "/" + name
+}
+
+func (store *s3Storage) getURL(key string, query url.Values) *url.URL {
+	var target = *store.endpoint
+	var objectPath = "/" + key
+	if store.pathStyle {
+		objectPath = "/" + store.bucket + objectPath
+	} else {
+		target.Host = store.bucket + "." + target.Host
+	}
+	target.Path = strings.TrimSuffix(target.Path, "/") + objectPath
+	target.RawPath = strings.TrimSuffix(store.endpoint.EscapedPath(), "/") + encodeS3(objectPath, true)
+	var keys = make([]string, 0, len(query))
+	for name := range query {
+		keys = append(keys, name)
+	}
+	sort.Strings(keys)
+	var pairs = []string{}
+	for _, name := range keys {
+		pairs = append(pairs, encodeS3(name, false)+"="+encodeS3(query.Get(name), false))
+	}
+	target.RawQuery = strings.Join(pairs, "&")
+	return &target
+}
+
+func (store *s3Storage) sign(request *http.Request, payloadHash string, now time.Time) {
+	var amzDate = now.UTC().Format("20060102T150405Z")
+	var shortDate = now.UTC().Format("20060102")
+	request.Header.Set("X-Amz-Date", amzDate)
+	request.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	var signedHeaders = "host;x-amz-content-sha256;x-amz-date"
+	var canonicalHeaders = fmt.Sprintf(
+		"host:%s\nx-amz-content-sha256:%s\nx-amz-date:%s\n",
+		request.URL.Host,
+		payloadHash,
+		amzDate,
+	)
+	var canonicalRequest = strings.Join(
+		[]string{
+			request.Method,
+			request.URL.EscapedPath(),
+			request.URL.RawQuery,
+			canonicalHeaders,
+			signedHeaders,
+			payloadHash,
+		},
+		"\n",
+	)
+	var scope = fmt.Sprintf("%s/%s/s3/aws4_request", shortDate, store.region)
+	var stringToSign = strings.Join(
+		[]string{
+			"AWS4-HMAC-SHA256",
+			amzDate,
+			scope,
+			getSHA256Hex([]byte(canonicalRequest)),
+		},
+		"\n",
+	)
+	var signingKey = getHMAC([]byte("AWS4"+store.secretKey), shortDate)
+	signingKey = getHMAC(signingKey, store.region)
+	signingKey = getHMAC(signingKey, "s3")
+	signingKey = getHMAC(signingKey, "aws4_request")
+	request.Header.Set(
+		"Authorization",
+		fmt.Sprintf(
+			"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+			store.accessKey,
+			scope,
+			signedHeaders,
+			hex.EncodeToString(getHMAC(signingKey, stringToSign)),
+		),
+	)
+}
+
+func (store *s3Storage) do(method string, key string, query url.Values, content []byte) (*http.Response, error) {
+	return store.doRequest(
+		method,
+		key,
+		query,
+		nil,
+		bytes.NewReader(content),
+		int64(len(content)),
+		getSHA256Hex(content),
+	)
+}
+
+func (store *s3Storage) doRequest(
+	method string,
+	key string,
+	query url.Values,
+	header http.Header,
+	body io.Reader,
+	length int64,
+	payloadHash string,
+) (*http.Response, error) {
+	var request, requestError = http.NewRequestWithContext(
+		context.Background(),
+		method,
+		store.getURL(key, query).String(),
+		body,
+	)
+	if requestError != nil {
+		return nil, requestError
+	}
+	for name, values := range header {
+		request.Header[name] = values
+	}
+	request.ContentLength = length
+	store.sign(request, payloadHash, time.Now())
+	var response, responseError = store.client.Do(request)
+	if responseError != nil {
+		return nil, responseError
+	}
+	if response.StatusCode == http.StatusNotFound {
+		response.Body.Close()
+		return nil, fmt.Errorf("%s %s: %w", method, key, os.ErrNotExist)
+	}
+	if response.StatusCode >= http.StatusMultipleChoices {
+		var detail, _ = io.ReadAll(io.LimitReader(response.Body, 1024))
+		response.Body.Close()
+		return nil, fmt.Errorf("%s %s: wrong response [%d]: %s", method, key, response.StatusCode, strings.TrimSpace(string(detail)))
+	}
+	return response, nil
+}
+
+func (store *s3Storage) Put(name string, content []byte) error {
+	var nameError = validateStorageName(name)
+	if nameError != nil {
+		return nameError
+	}
+	var response, responseError = store.do(http.MethodPut, store.getKey(name), nil, content)
+	if responseError != nil {
+		return responseError
+	}
+	return response.Body.Close()
+}
+
+func (store *s3Storage) Get(name string) ([]byte, error) {
+	var nameError = validateStorageName(name)
+	if nameError != nil {
+		return nil, nameError
+	}
+	var response, responseError = store.do(http.MethodGet, store.getKey(name), nil, nil)
+	if responseError != nil {
+		return nil, responseError
+	}
+	defer response.Body.Close()
+	return io.ReadAll(response.Body)
+}
+
+type s3StorageWriter struct {
+	store  *s3Storage
+	key    string
+	file   *os.File
+	digest hash.Hash
+	size   int64
+}
+
+func (writer *s3StorageWriter) Write(content []byte) (int, error) {
+	var written, writeError = writer.file.Write(content)
+	writer.digest.Write(content[:written])
+	writer.size += int64(written)
+	return written, writeError
+}
+
+func (writer *s3StorageWriter) Sync() error {
+	return writer.file.Sync()
+}
+
+func (writer *s3StorageWriter) upload(key string) error {
+	defer writer.Abort()
+	var _, seekError = writer.file.Seek(0, io.SeekStart)
+	if seekError != nil {
+		return seekError
+	}
+	var response, responseError = writer.store.doRequest(
+		http.MethodPut,
+		key,
+		nil,
+		nil,
+		writer.file,
+		writer.size,
+		hex.EncodeToString(writer.digest.Sum(nil)),
+	)
+	if responseError != nil {
+		return responseError
+	}
+	return response.Body.Close()
+}
+
+func (writer *s3StorageWriter) Close() error {
+	return writer.upload(writer.key)
+}
+
+func (writer *s3StorageWriter) Keep() error {
+	return writer.upload(writer.key + STORAGE_PARTIAL_SUFFIX)
+}
+
+func (writer *s3StorageWriter) Abort() error {
+	writer.file.Close()
+	return os.Remove(writer.file.Name())
+}
+
+func (store *s3Storage) Create(name string) (storageWriter, error) {
+	var nameError = validateStorageName(name)
+	if nameError != nil {
+		return nil, nameError
+	}
+	var file, fileError = os.CreateTemp(store.staging, S3_UPLOAD_PATTERN)
+	if fileError != nil {
+		return nil, fileError
+	}
+	return &s3StorageWriter{
+		store:  store,
+		key:    store.getKey(name),
+		file:   file,
+		digest: sha256.New(),
+	}, nil
+}
+
+type s3StorageReader struct {
+	store  *s3Storage
+	key    string
+	size   int64
+	offset int64
+	body   io.ReadCloser
+}
+
+func (reader *s3StorageReader) Read(content []byte) (int, error) {
+	if reader.offset >= reader.size {
+		return 0, io.EOF
+	}
+	if reader.body == nil {
+		var response, responseError = reader.store.doRequest(
+			http.MethodGet,
+			reader.key,
+			nil,
+			http.Header{
+				"Range": []string{fmt.Sprintf("bytes=%d-", reader.offset)},
+			},
+			nil,
+			0,
+			getSHA256Hex(nil),
+		)
+		if responseError != nil {
+			return 0, responseError
+		}
+		reader.body = response.Body
+	}
+	var read, readError = reader.body.Read(content)
+	reader.offset += int64(read)
+	return read, readError
+}
+
+func (reader *s3StorageReader) Seek(offset int64, whence int) (int64, error) {
+	var target = offset
+	switch whence {
+	case io.SeekCurrent:
+		target += reader.offset
+	case io.SeekEnd:
+		target += reader.size
+	}
+	if target < 0 {
+		return reader.offset, fmt.Errorf("seek %s: negative position %d", reader.key, target)
+	}
+	if target != reader.offset && reader.body != nil {
+		reader.body.Close()
+		reader.body = nil
+	}
+	reader.offset = target
+	return target, nil
+}
+
+func (reader *s3StorageReader) Close() error {
+	if reader.body == nil {
+		return nil
+	}
+	return reader.body.Close()
+}
+
+func (store *s3Storage) Open(name string) (storageReader, error) {
+	var object, objectError = store.Stat(name)
+	if objectError != nil {
+		return nil, objectError
+	}
+	return &s3StorageReader{
+		store: store,
+		key:   store.getKey(name),
+		size:  object.Size,
+	}, nil
+}
+
+func (store *s3Storage) Stat(name string) (storageObject, error) {
+	var nameError = validateStorageName(name)
+	if nameError != nil {
+		return storageObject{}, nameError
+	}
+	var response, responseError = store.do(http.MethodHead, store.getKey(name), nil, nil)
+	if responseError != nil {
+		return storageObject{}, responseError
+	}
+	response.Body.Close()
+	var modTime, _ = http.ParseTime(response.Header.Get("Last-Modified"))
+	return storageObject{
+		Name:    name,
+		Size:    response.ContentLength,
+		ModTime: modTime,
+	}, nil
+}
+
+func (store *s3Storage) Delete(name string) error {
+	var nameError = validateStorageName(name)
+	if nameError != nil {
+		return nameError
+	}
+	var response, responseError = store.do(http.MethodDelete, store.getKey(name), nil, nil)
+	if responseError != nil {
+		if errors.Is(responseError, os.ErrNotExist) {
+			return nil
+		}
+		return responseError
+	}
+	return response.Body.Close()
+}
+
+func (store *s3Storage) List(prefix string) ([]storageObject, error) {
+	var objects = []storageObject{}
+	var rootPrefix = ""
+	if store.prefix != "" {
+		rootPrefix = store.prefix + "/"
+	}
+	var query = url.Values{
+		"list-type": []string{"2"},
+		"prefix":    []string{rootPrefix + prefix},
+	}
+	for {
+		var response, responseError = store.do(http.MethodGet, "", query, nil)
+		if responseError != nil {
+			return nil, responseError
+		}
+		var result s3ListResult
+		var resultError = xml.NewDecoder(response.Body).Decode(&result)
+		response.Body.Close()
+		if resultError != nil {
+			return nil, resultError
+		}
+		for _, content := range result.Contents {
+			objects = append(objects, storageObject{
+				Name:    strings.TrimPrefix(content.Key, rootPrefix),
+				Size:    content.Size,
+				ModTime: content.LastModified,
+			})
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return objects, nil
+		}
+		query.Set("continuation-token", result.NextContinuationToken)
+	}
+}
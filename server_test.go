@@ -0,0 +1,333 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	webserver "github.com/zhongjie-cai/web-server"
+)
+
+type testCustomization struct {
+	myCustomization
+	handlers chan http.Handler
+}
+
+type idleListener struct{}
+
+func (idleListener) Accept() (net.Conn, error) {
+	select {}
+}
+
+func (idleListener) Close() error {
+	return nil
+}
+
+func (idleListener) Addr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}
+}
+
+func (customization *testCustomization) PreBootstrap() error {
+	return nil
+}
+
+func (customization *testCustomization) PostBootstrap() error {
+	return nil
+}
+
+func (customization *testCustomization) Listener() net.Listener {
+	return idleListener{}
+}
+
+func (customization *testCustomization) WrapHandler(handler http.Handler) http.Handler {
+	customization.handlers <- handler
+	return handler
+}
+
+func (customization *testCustomization) Log(session webserver.Session, logType webserver.LogType, logLevel webserver.LogLevel, category, subcategory, description string) {
+}
+
+var testHandler struct {
+	once    sync.Once
+	handler http.Handler
+}
+
+func getTestHandler() http.Handler {
+	testHandler.once.Do(func() {
+		var customization = &testCustomization{
+			handlers: make(chan http.Handler),
+		}
+		var application = webserver.NewApplication(
+			"ImageProcessor",
+			"127.0.0.1:0",
+			APP_VERSION,
+			customization,
+		)
+		appSession = application.Session()
+		go application.Start()
+		testHandler.handler = <-customization.handlers
+	})
+	return testHandler.handler
+}
+
+func startTestServer(t *testing.T, workers int, latency time.Duration) string {
+	var reactor = httptest.NewServer(newFakeReactor(latency, 0, http.StatusServiceUnavailable).handler())
+	t.Cleanup(reactor.Close)
+	var savedBackends = backends
+	t.Cleanup(func() {
+		backends = savedBackends
+	})
+	useTestStorage(t)
+	backends = newBackendPool(map[string]int{})
+	appConfig.MinFreeBytes = 0
+	appConfig.DefaultReactorAPI = reactor.URL + "/reactor/image"
+	appConfig.DefaultFaceModelsAPI = reactor.URL + "/reactor/facemodels"
+	appConfig.AllowedBackends = map[string]string{
+		"fake": reactor.URL,
+	}
+	var server = httptest.NewServer(getTestHandler())
+	t.Cleanup(server.Close)
+	startWorkers(workers)
+	return server.URL
+}
+
+func submitTestImages(t *testing.T, address string, names ...string) submittedJob {
+	var response, content = postTestImages(t, address, names...)
+	if response.StatusCode != http.StatusAccepted {
+		t.Fatalf("submit: %d %s", response.StatusCode, content)
+	}
+	var submitted struct {
+		Jobs []submittedJob `json:"jobs"`
+	}
+	json.Unmarshal(content, &submitted)
+	if len(submitted.Jobs) != 1 {
+		t.Fatalf("expected one job, got %+v", submitted)
+	}
+	return submitted.Jobs[0]
+}
+
+func waitForTestJob(t *testing.T, address string, statusURL string) job {
+	for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(20 * time.Millisecond) {
+		var response, err = http.Get(address + statusURL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var status job
+		json.NewDecoder(response.Body).Decode(&status)
+		response.Body.Close()
+		if status.FinishedAt != nil {
+			return status
+		}
+	}
+	t.Fatalf("job %s did not finish", statusURL)
+	return job{}
+}
+
+func getTestResponse(t *testing.T, url string, contentRange string) (*http.Response, []byte) {
+	var request, _ = http.NewRequest(http.MethodGet, url, nil)
+	if contentRange != "" {
+		request.Header.Set("Range", contentRange)
+	}
+	var response, err = http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	var content, _ = io.ReadAll(response.Body)
+	return response, content
+}
+
+func TestSubmitProcessAndDownload(t *testing.T) {
+	var address = startTestServer(t, 2, 0)
+	var submitted = submitTestImages(t, address, "a.png", "b.png")
+	var status = waitForTestJob(t, address, submitted.StatusURL)
+	if status.State != JOB_STATE_DONE || status.Processor != DEFAULT_PROCESSOR || len(status.Images) != 2 {
+		t.Fatalf("unexpected job %+v", status)
+	}
+	for index, outcome := range status.Images {
+		if outcome.Error != "" || outcome.ResultError != "" {
+			t.Fatalf("image %d failed: %+v", index, outcome)
+		}
+	}
+	var response, content = getTestResponse(t, address+status.Images[0].DownloadURL, "bytes=0-1")
+	if response.StatusCode != http.StatusPartialContent || !bytes.Equal(content, []byte{0xff, 0xd8}) {
+		t.Fatalf("ranged image download: %d %x", response.StatusCode, content)
+	}
+	response, content = getTestResponse(t, address+status.Images[1].ThumbnailURL, "")
+	if response.StatusCode != http.StatusOK || len(content) == 0 {
+		t.Fatalf("thumbnail download: %d", response.StatusCode)
+	}
+	response, content = getTestResponse(t, address+submitted.DownloadURL, "")
+	if response.StatusCode != http.StatusOK {
+		t.Fatalf("archive download: %d %s", response.StatusCode, content)
+	}
+	var archive, archiveErr = zip.NewReader(bytes.NewReader(content), int64(len(content)))
+	if archiveErr != nil {
+		t.Fatal(archiveErr)
+	}
+	var names = []string{}
+	for _, file := range archive.File {
+		names = append(names, file.Name)
+	}
+	if len(names) != 2 || names[0] == names[1] || !strings.HasSuffix(names[0], ".jpg") {
+		t.Fatalf("unexpected archive entries %v", names)
+	}
+	var objects, _ = outputs.List(getResultsDir(status.Counter) + "/")
+	for _, object := range objects {
+		if !strings.Contains(object.Name, "/thumbnails/") {
+			t.Fatalf("result copies should be dropped once archived, found %s", object.Name)
+		}
+	}
+}
+
+func TestDownloadAndDeleteNeedsTheLastByte(t *testing.T) {
+	var address = startTestServer(t, 2, 0)
+	var submitted = submitTestImages(t, address, "a.png", "b.png")
+	var status = waitForTestJob(t, address, submitted.StatusURL)
+	var object, statErr = outputs.Stat(status.File)
+	if statErr != nil {
+		t.Fatal(statErr)
+	}
+	var deleteURL = fmt.Sprint(address, "/dnd/", status.Counter)
+	var response, content = getTestResponse(t, deleteURL, "bytes=0-9")
+	if response.StatusCode != http.StatusPartialContent || len(content) != 10 {
+		t.Fatalf("partial download: %d %d", response.StatusCode, len(content))
+	}
+	if _, found := jobs.Get(status.Counter); !found {
+		t.Fatal("a partial download must not delete the job")
+	}
+	response, content = getTestResponse(t, deleteURL, fmt.Sprintf("bytes=10-%d", object.Size-1))
+	if response.StatusCode != http.StatusPartialContent || int64(len(content)) != object.Size-10 {
+		t.Fatalf("remaining download: %d %d", response.StatusCode, len(content))
+	}
+	if _, found := jobs.Get(status.Counter); found {
+		t.Fatal("downloading the last byte should delete the job")
+	}
+	if _, err := outputs.Stat(status.File); err == nil {
+		t.Fatal("downloading the last byte should delete the archive")
+	}
+}
+
+func postTestAction(t *testing.T, url string) {
+	var response, err = http.Post(url, "application/json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		t.Fatalf("%s: %d", url, response.StatusCode)
+	}
+}
+
+func TestPausedJobReleasesWorker(t *testing.T) {
+	var address = startTestServer(t, 1, 100*time.Millisecond)
+	var paused = submitTestImages(t, address, "a.png", "b.png", "c.png", "d.png")
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		var current, _ = jobs.Get(paused.Counter)
+		if current.State == JOB_STATE_RUNNING {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("first job did not start")
+		}
+	}
+	postTestAction(t, address+paused.StatusURL+"/pause")
+	var other = submitTestImages(t, address, "e.png", "f.png")
+	var otherStatus = waitForTestJob(t, address, other.StatusURL)
+	if otherStatus.State != JOB_STATE_DONE {
+		t.Fatalf("second job should run while the first is paused, got %+v", otherStatus)
+	}
+	var pausedStatus, _ = jobs.Get(paused.Counter)
+	if pausedStatus.State != JOB_STATE_PAUSED || pausedStatus.FinishedAt != nil || pausedStatus.Current == len(pausedStatus.Images) {
+		t.Fatalf("first job should stay paused with images left, got %+v", pausedStatus)
+	}
+	postTestAction(t, address+paused.StatusURL+"/resume")
+	var resumedStatus = waitForTestJob(t, address, paused.StatusURL)
+	if resumedStatus.State != JOB_STATE_DONE || resumedStatus.Current != 4 {
+		t.Fatalf("resumed job should finish every image, got %+v", resumedStatus)
+	}
+	if names := readArchiveNames(t, resumedStatus.File); len(names) != 4 {
+		t.Fatalf("resumed job should archive every image, got %v", names)
+	}
+}
+
+func TestCancelSuspendedJob(t *testing.T) {
+	var address = startTestServer(t, 1, 100*time.Millisecond)
+	var submitted = submitTestImages(t, address, "a.png", "b.png", "c.png")
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		var current, _ = jobs.Get(submitted.Counter)
+		if current.State == JOB_STATE_RUNNING {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("job did not start")
+		}
+	}
+	postTestAction(t, address+submitted.StatusURL+"/pause")
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		var control, _ = controls.get(submitted.Counter)
+		control.lock.Lock()
+		var parked = control.suspended != nil
+		control.lock.Unlock()
+		if parked {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("paused job was not suspended")
+		}
+	}
+	var request, _ = http.NewRequest(http.MethodDelete, address+submitted.StatusURL, nil)
+	var response, err = http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	var status, _ = jobs.Get(submitted.Counter)
+	if status.State != JOB_STATE_CANCELED || status.FinishedAt == nil || status.PartialFile != "" {
+		t.Fatalf("canceling a suspended job should finish it, got %+v", status)
+	}
+	if names := readArchiveNames(t, status.File); len(names) == 0 || len(names) == 3 {
+		t.Fatalf("canceled job should keep only the finished images, got %v", names)
+	}
+}
+
+func postTestImages(t *testing.T, address string, names ...string) (*http.Response, []byte) {
+	var body bytes.Buffer
+	var form = multipart.NewWriter(&body)
+	for _, name := range names {
+		var part, _ = form.CreateFormFile("target_image", name)
+		part.Write(getTestPNG(t))
+	}
+	form.Close()
+	var response, err = http.Post(address+"/process", form.FormDataContentType(), &body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	var content, _ = io.ReadAll(response.Body)
+	return response, content
+}
+
+func TestFullQueueOnlyRefusesBatches(t *testing.T) {
+	var address = startTestServer(t, 0, 0)
+	queue = newJobQueue(1)
+	submitTestImages(t, address, "a.png", "b.png")
+	var batch, _ = postTestImages(t, address, "c.png", "d.png")
+	if batch.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("expected a batch to be refused while the queue is full, got %d", batch.StatusCode)
+	}
+	var single, content = postTestImages(t, address, "e.png")
+	if single.StatusCode != http.StatusOK || len(content) == 0 {
+		t.Fatalf("expected a single image to be processed synchronously, got %d %s", single.StatusCode, content)
+	}
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+type storageObject struct {
+	Name    string
+	Size    int64
+	ModTime time.Time
+}
+
+const STORAGE_PARTIAL_SUFFIX string = ".part"
+
+type storageWriter interface {
+	io.Writer
+	Sync() error
+	Close() error
+	Keep() error
+	Abort() error
+}
+
+type storageReader interface {
+	io.ReadSeeker
+	io.Closer
+}
+
+type storage interface {
+	Put(name string, content []byte) error
+	Get(name string) ([]byte, error)
+	Create(name string) (storageWriter, error)
+	Open(name string) (storageReader, error)
+	Stat(name string) (storageObject, error)
+	Delete(name string) error
+	List(prefix string) ([]storageObject, error)
+}
+
+var outputs storage
+
+var errInvalidStorageName = errors.New("invalid storage object name")
+
+func getStorageName(elements ...string) string {
+	return path.Join(elements...)
+}
+
+func validateStorageName(name string) error {
+	if name == "" ||
+		strings.HasPrefix(name, "/") ||
+		strings.Contains(name, "\\") ||
+		path.Clean(name) != name ||
+		name == ".." ||
+		strings.HasPrefix(name, "../") {
+		return fmt.Errorf("%w: %q", errInvalidStorageName, name)
+	}
+	return nil
+}
+
+func newStorage() (storage, error) {
+	switch appConfig.Storage {
+	case "s3":
+		return newS3Storage(
+			appConfig.S3Endpoint,
+			appConfig.S3Region,
+			appConfig.S3Bucket,
+			appConfig.S3Prefix,
+			appConfig.S3AccessKey,
+			appConfig.S3SecretKey,
+			appConfig.S3PathStyle,
+			filepath.Join(appConfig.OutputDir, S3_STAGING_DIR),
+		)
+	default:
+		return newLocalStorage(appConfig.OutputDir)
+	}
+}
+
+type localStorage struct {
+	root string
+}
+
+func newLocalStorage(root string) (*localStorage, error) {
+	var mkdirError = os.MkdirAll(root, 0755)
+	if mkdirError != nil {
+		return nil, mkdirError
+	}
+	return &localStorage{
+		root: root,
+	}, nil
+}
+
+func (store *localStorage) getPath(name string) (string, error) {
+	var nameError = validateStorageName(name)
+	if nameError != nil {
+		return "", nameError
+	}
+	return filepath.Join(store.root, filepath.FromSlash(name)), nil
+}
+
+func (store *localStorage) Put(name string, content []byte) error {
+	var filename, filenameError = store.getPath(name)
+	if filenameError != nil {
+		return filenameError
+	}
+	var mkdirError = os.MkdirAll(filepath.Dir(filename), 0755)
+	if mkdirError != nil {
+		return mkdirError
+	}
+	var tempName = filename + ".tmp"
+	var writeError = os.WriteFile(tempName, content, 0644)
+	if writeError != nil {
+		return writeError
+	}
+	return os.Rename(tempName, filename)
+}
+
+func (store *localStorage) Get(name string) ([]byte, error) {
+	var filename, filenameError = store.getPath(name)
+	if filenameError != nil {
+		return nil, filenameError
+	}
+	return os.ReadFile(filename)
+}
+
+type localStorageWriter struct {
+	file     *os.File
+	filename string
+}
+
+func (writer *localStorageWriter) Write(content []byte) (int, error) {
+	return writer.file.Write(content)
+}
+
+func (writer *localStorageWriter) Sync() error {
+	return writer.file.Sync()
+}
+
+func (writer *localStorageWriter) Close() error {
+	var closeError = writer.file.Close()
+	if closeError != nil {
+		return closeError
+	}
+	return os.Rename(writer.file.Name(), writer.filename)
+}
+
+func (writer *localStorageWriter) Keep() error {
+	return writer.file.Close()
+}
+
+func (writer *localStorageWriter) Abort() error {
+	writer.file.Close()
+	return os.Remove(writer.file.Name())
+}
+
+func (store *localStorage) Create(name string) (storageWriter, error) {
+	var filename, filenameError = store.getPath(name)
+	if filenameError != nil {
+		return nil, filenameError
+	}
+	var mkdirError = os.MkdirAll(filepath.Dir(filename), 0755)
+	if mkdirError != nil {
+		return nil, mkdirError
+	}
+	var file, fileError = os.Create(filename + STORAGE_PARTIAL_SUFFIX)
+	if fileError != nil {
+		return nil, fileError
+	}
+	return &localStorageWriter{
+		file:     file,
+		filename: filename,
+	}, nil
+}
+
+func (store *localStorage) Open(name string) (storageReader, error) {
+	var filename, filenameError = store.getPath(name)
+	if filenameError != nil {
+		return nil, filenameError
+	}
+	return os.Open(filename)
+}
+
+func (store *localStorage) Stat(name string) (storageObject, error) {
+	var filename, filenameError = store.getPath(name)
+	if filenameError != nil {
+		return storageObject{}, filenameError
+	}
+	var info, infoError = os.Stat(filename)
+	if infoError != nil {
+		return storageObject{}, infoError
+	}
+	return storageObject{
+		Name:    name,
+		Size:    info.Size(),
+		ModTime: info.ModTime(),
+	}, nil
+}
+
+func (store *localStorage) Delete(name string) error {
+	var filename, filenameError = store.getPath(name)
+	if filenameError != nil {
+		return filenameError
+	}
+	var removeError = os.Remove(filename)
+	if errors.Is(removeError, os.ErrNotExist) {
+		return nil
+	}
+	var parent = filepath.Dir(filename)
+	for parent != filepath.Clean(store.root) && os.Remove(parent) == nil {
+		parent = filepath.Dir(parent)
+	}
+	return removeError
+}
+
+func (store *localStorage) List(prefix string) ([]storageObject, error) {
+	var objects = []storageObject{}
+	var start = store.root
+	if separator := strings.LastIndex(prefix, "/"); separator > 0 {
+		start = filepath.Join(store.root, filepath.FromSlash(prefix[:separator]))
+	}
+	var walkError = filepath.WalkDir(
+		start,
+		func(filename string, entry fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if entry.IsDir() ||
+				strings.HasSuffix(filename, ".tmp") ||
+				strings.HasSuffix(filename, STORAGE_PARTIAL_SUFFIX) {
+				return nil
+			}
+			var relative, relativeError = filepath.Rel(store.root, filename)
+			if relativeError != nil {
+				return relativeError
+			}
+			var name = filepath.ToSlash(relative)
+			if !strings.HasPrefix(name, prefix) {
+				return nil
+			}
+			var info, infoError = entry.Info()
+			if infoError != nil {
+				return nil
+			}
+			objects = append(objects, storageObject{
+				Name:    name,
+				Size:    info.Size(),
+				ModTime: info.ModTime(),
+			})
+			return nil
+		},
+	)
+	if errors.Is(walkError, os.ErrNotExist) {
+		return objects, nil
+	}
+	sort.Slice(
+		objects,
+		func(i, j int) bool {
+			return objects[i].Name < objects[j].Name
+		},
+	)
+	return objects, walkError
+}
@@ -0,0 +1,360 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+const JOB_STORE_FILE string = "jobs.json"
+
+const LEGACY_OUTPUT_DIR string = "."
+
+const JOB_STORE_FLUSH_DELAY time.Duration = time.Second
+
+type jobState string
+
+const (
+	JOB_STATE_QUEUED   jobState = "queued"
+	JOB_STATE_RUNNING  jobState = "running"
+	JOB_STATE_PAUSED   jobState = "paused"
+	JOB_STATE_DONE     jobState = "done"
+	JOB_STATE_FAILED   jobState = "failed"
+	JOB_STATE_CANCELED jobState = "canceled"
+)
+
+type imageOutcome struct {
+	Name         string         `json:"name"`
+	Output       string         `json:"output,omitempty"`
+	DownloadURL  string         `json:"download_url,omitempty"`
+	ThumbnailURL string         `json:"thumbnail_url,omitempty"`
+	ResultError  string         `json:"result_error,omitempty"`
+	Error        string         `json:"error,omitempty"`
+	TimedOut     bool           `json:"timed_out,omitempty"`
+	Attempts     []imageAttempt `json:"attempts,omitempty"`
+	StartedAt    *time.Time     `json:"started_at,omitempty"`
+	FinishedAt   *time.Time     `json:"finished_at,omitempty"`
+}
+
+type job struct {
+	Counter         int            `json:"counter"`
+	State           jobState       `json:"state"`
+	QueuePosition   int            `json:"queue_position,omitempty"`
+	NamePrefix      string         `json:"name_prefix"`
+	Processor       string         `json:"processor,omitempty"`
+	ReactorAPI      string         `json:"reactor_api"`
+	Quality         int            `json:"quality"`
+	Options         reactorOptions `json:"options"`
+	LegacyWeight    float64        `json:"codeformer_weight,omitempty"`
+	Priority        int            `json:"priority"`
+	Submitter       string         `json:"submitter,omitempty"`
+	Total           int            `json:"total"`
+	InputBytes      int64          `json:"input_bytes,omitempty"`
+	Current         int            `json:"current"`
+	File            string         `json:"file,omitempty"`
+	PartialFile     string         `json:"partial_file,omitempty"`
+	RetryOf         int            `json:"retry_of,omitempty"`
+	CarriedOver     []string       `json:"carried_over,omitempty"`
+	Error           string         `json:"error,omitempty"`
+	Images          []imageOutcome `json:"images"`
+	CreatedAt       time.Time      `json:"created_at"`
+	StartedAt       *time.Time     `json:"started_at,omitempty"`
+	FinishedAt      *time.Time     `json:"finished_at,omitempty"`
+	InputsKeptUntil *time.Time     `json:"inputs_kept_until,omitempty"`
+}
+
+func (job *job) migrate() {
+	if job.Options.FaceRestorer == "" {
+		job.Options = defaultReactorOptions.clone()
+		if job.LegacyWeight != 0 {
+			job.Options.CodeFormerWeight = job.LegacyWeight
+		}
+	}
+	job.LegacyWeight = 0
+}
+
+func (job *job) clone() *job {
+	var copied = *job
+	copied.Images = append([]imageOutcome(nil), job.Images...)
+	copied.CarriedOver = append([]string(nil), job.CarriedOver...)
+	copied.Options = job.Options.clone()
+	return &copied
+}
+
+type jobStore interface {
+	Create(job *job) (int, error)
+	Get(counter int) (*job, bool)
+	List() []*job
+	Update(counter int, mutate func(job *job)) (*job, error)
+	Delete(counter int) error
+	Sync() error
+}
+
+var jobs jobStore
+
+var errJobNotFound = errors.New("job not found")
+
+type memoryJobStore struct {
+	lock    sync.RWMutex
+	jobs    map[int]*job
+	counter int
+}
+
+func newMemoryJobStore() *memoryJobStore {
+	return &memoryJobStore{
+		jobs: map[int]*job{},
+	}
+}
+
+func (store *memoryJobStore) Create(job *job) (int, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	store.counter++
+	var created = job.clone()
+	created.Counter = store.counter
+	if created.CreatedAt.IsZero() {
+		created.CreatedAt = time.Now()
+	}
+	store.jobs[created.Counter] = created
+	return created.Counter, nil
+}
+
+func (store *memoryJobStore) Get(counter int) (*job, bool) {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+	var found, ok = store.jobs[counter]
+	if !ok {
+		return nil, false
+	}
+	return found.clone(), true
+}
+
+func (store *memoryJobStore) List() []*job {
+	store.lock.RLock()
+	var all = make([]*job, 0, len(store.jobs))
+	for _, entry := range store.jobs {
+		all = append(all, entry.clone())
+	}
+	store.lock.RUnlock()
+	sort.Slice(
+		all,
+		func(i, j int) bool {
+			return all[i].Counter < all[j].Counter
+		},
+	)
+	return all
+}
+
+func (store *memoryJobStore) Update(counter int, mutate func(job *job)) (*job, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	var found, ok = store.jobs[counter]
+	if !ok {
+		return nil, fmt.Errorf("%w: counter %d", errJobNotFound, counter)
+	}
+	mutate(found)
+	found.Counter = counter
+	return found.clone(), nil
+}
+
+func (store *memoryJobStore) Delete(counter int) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	delete(store.jobs, counter)
+	return nil
+}
+
+func (store *memoryJobStore) Sync() error {
+	return nil
+}
+
+type fileJobStore struct {
+	memory       *memoryJobStore
+	path         string
+	flushLock    sync.Mutex
+	pendingLock  sync.Mutex
+	pendingFlush *time.Timer
+}
+
+type fileJobStoreContent struct {
+	Counter int    `json:"counter"`
+	Jobs    []*job `json:"jobs"`
+}
+
+func newFileJobStore(path string) (*fileJobStore, error) {
+	var store = &fileJobStore{
+		memory: newMemoryJobStore(),
+		path:   path,
+	}
+	var mkdirError = os.MkdirAll(filepath.Dir(path), 0755)
+	if mkdirError != nil {
+		return nil, mkdirError
+	}
+	var fileBytes, fileBytesError = os.ReadFile(path)
+	if errors.Is(fileBytesError, os.ErrNotExist) {
+		return store, nil
+	}
+	if fileBytesError != nil {
+		return nil, fileBytesError
+	}
+	var content fileJobStoreContent
+	var contentError = json.Unmarshal(fileBytes, &content)
+	if contentError != nil {
+		return nil, fmt.Errorf("corrupt job store %s: %w", path, contentError)
+	}
+	store.memory.counter = content.Counter
+	for _, entry := range content.Jobs {
+		entry.migrate()
+		store.memory.jobs[entry.Counter] = entry
+		if entry.Counter > store.memory.counter {
+			store.memory.counter = entry.Counter
+		}
+	}
+	return store, nil
+}
+
+func (store *fileJobStore) flush() error {
+	store.flushLock.Lock()
+	defer store.flushLock.Unlock()
+	store.memory.lock.RLock()
+	var content = fileJobStoreContent{
+		Counter: store.memory.counter,
+	}
+	for _, entry := range store.memory.jobs {
+		content.Jobs = append(content.Jobs, entry.clone())
+	}
+	store.memory.lock.RUnlock()
+	sort.Slice(
+		content.Jobs,
+		func(i, j int) bool {
+			return content.Jobs[i].Counter < content.Jobs[j].Counter
+		},
+	)
+	var fileBytes, fileBytesError = json.MarshalIndent(content, "", "  ")
+	if fileBytesError != nil {
+		return fileBytesError
+	}
+	var tempPath = store.path + ".tmp"
+	var writeError = os.WriteFile(tempPath, fileBytes, 0644)
+	if writeError != nil {
+		return writeError
+	}
+	return os.Rename(tempPath, store.path)
+}
+
+func (store *fileJobStore) Create(job *job) (int, error) {
+	var counter, createError = store.memory.Create(job)
+	if createError != nil {
+		return 0, createError
+	}
+	return counter, store.flush()
+}
+
+func (store *fileJobStore) Get(counter int) (*job, bool) {
+	return store.memory.Get(counter)
+}
+
+func (store *fileJobStore) List() []*job {
+	return store.memory.List()
+}
+
+func (store *fileJobStore) scheduleFlush() {
+	store.pendingLock.Lock()
+	defer store.pendingLock.Unlock()
+	if store.pendingFlush != nil {
+		return
+	}
+	store.pendingFlush = time.AfterFunc(
+		JOB_STORE_FLUSH_DELAY,
+		func() {
+			store.pendingLock.Lock()
+			store.pendingFlush = nil
+			store.pendingLock.Unlock()
+			store.flush()
+		},
+	)
+}
+
+func (store *fileJobStore) Update(counter int, mutate func(job *job)) (*job, error) {
+	var updated, updateError = store.memory.Update(counter, mutate)
+	if updateError != nil {
+		return nil, updateError
+	}
+	store.scheduleFlush()
+	return updated, nil
+}
+
+func (store *fileJobStore) Delete(counter int) error {
+	var deleteError = store.memory.Delete(counter)
+	if deleteError != nil {
+		return deleteError
+	}
+	return store.flush()
+}
+
+func (store *fileJobStore) Sync() error {
+	store.pendingLock.Lock()
+	if store.pendingFlush != nil {
+		store.pendingFlush.Stop()
+		store.pendingFlush = nil
+	}
+	store.pendingLock.Unlock()
+	return store.flush()
+}
+
+func moveLegacyOutput(legacyDir string, name string) error {
+	var source = filepath.Join(legacyDir, filepath.FromSlash(name))
+	var target = filepath.Join(appConfig.OutputDir, filepath.FromSlash(name))
+	if _, statError := os.Stat(source); errors.Is(statError, os.ErrNotExist) {
+		return nil
+	}
+	if _, statError := os.Stat(target); statError == nil {
+		return nil
+	}
+	var mkdirError = os.MkdirAll(filepath.Dir(target), 0755)
+	if mkdirError != nil {
+		return mkdirError
+	}
+	return os.Rename(source, target)
+}
+
+func migrateLegacyOutputs(legacyDir string) error {
+	var legacyPath, legacyPathError = filepath.Abs(legacyDir)
+	var outputPath, outputPathError = filepath.Abs(appConfig.OutputDir)
+	if legacyPathError != nil || outputPathError != nil || legacyPath == outputPath {
+		return errors.Join(legacyPathError, outputPathError)
+	}
+	if _, statError := os.Stat(filepath.Join(legacyDir, JOB_STORE_FILE)); statError != nil {
+		return nil
+	}
+	if _, statError := os.Stat(filepath.Join(appConfig.OutputDir, JOB_STORE_FILE)); statError == nil {
+		return nil
+	}
+	var legacyStore, legacyStoreError = newFileJobStore(filepath.Join(legacyDir, JOB_STORE_FILE))
+	if legacyStoreError != nil {
+		return legacyStoreError
+	}
+	if appConfig.Storage == "local" {
+		var names = []string{
+			appConfig.InputsDir,
+			appConfig.ResultsDir,
+		}
+		for _, entry := range legacyStore.List() {
+			if validateStorageName(entry.File) == nil {
+				names = append(names, entry.File)
+			}
+		}
+		for _, name := range names {
+			var moveError = moveLegacyOutput(legacyDir, name)
+			if moveError != nil {
+				return fmt.Errorf("unable to move %s into %s: %w", name, appConfig.OutputDir, moveError)
+			}
+		}
+	}
+	return moveLegacyOutput(legacyDir, JOB_STORE_FILE)
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFileJobStoreBatchesUpdates(t *testing.T) {
+	var path = filepath.Join(t.TempDir(), "outputs", JOB_STORE_FILE)
+	var store, err = newFileJobStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var counter, createErr = store.Create(&job{NamePrefix: "IMG"})
+	if createErr != nil {
+		t.Fatal(createErr)
+	}
+	var written, _ = os.Stat(path)
+	for i := 0; i < 100; i++ {
+		store.Update(counter, func(job *job) {
+			job.Current++
+		})
+	}
+	var afterUpdates, _ = os.Stat(path)
+	if !afterUpdates.ModTime().Equal(written.ModTime()) || afterUpdates.Size() != written.Size() {
+		t.Fatal("updates should not rewrite the job store immediately")
+	}
+	if err := store.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	var reloaded, reloadErr = newFileJobStore(path)
+	if reloadErr != nil {
+		t.Fatal(reloadErr)
+	}
+	var restored, found = reloaded.Get(counter)
+	if !found || restored.Current != 100 || restored.NamePrefix != "IMG" {
+		t.Fatalf("unexpected restored job %+v", restored)
+	}
+}
+
+func TestFileJobStoreFlushesDelayedUpdates(t *testing.T) {
+	var path = filepath.Join(t.TempDir(), JOB_STORE_FILE)
+	var store, _ = newFileJobStore(path)
+	var counter, _ = store.Create(&job{})
+	store.Update(counter, func(job *job) {
+		job.Error = "delayed"
+	})
+	for deadline := time.Now().Add(JOB_STORE_FLUSH_DELAY + 5*time.Second); time.Now().Before(deadline); time.Sleep(50 * time.Millisecond) {
+		var content, _ = os.ReadFile(path)
+		if strings.Contains(string(content), "delayed") {
+			return
+		}
+	}
+	t.Fatal("delayed update was never written")
+}
+
+func TestFileJobStoreMigratesLegacyJobs(t *testing.T) {
+	var path = filepath.Join(t.TempDir(), JOB_STORE_FILE)
+	os.WriteFile(path, []byte(`{"counter":3,"jobs":[{"counter":3,"options":{},"codeformer_weight":0.8}]}`), 0644)
+	var store, err = newFileJobStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var migrated, _ = store.Get(3)
+	if migrated.Options.CodeFormerWeight != 0.8 || migrated.Options.FaceRestorer == "" {
+		t.Fatalf("legacy job was not migrated: %+v", migrated.Options)
+	}
+	var next, _ = store.Create(&job{})
+	if next != 4 {
+		t.Fatalf("counter should continue after restored jobs, got %d", next)
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"sync"
+)
+
+type endpointLimiter struct {
+	lock  sync.Mutex
+	slots map[string]chan struct{}
+}
+
+var endpoints = &endpointLimiter{
+	slots: map[string]chan struct{}{},
+}
+
+func (limiter *endpointLimiter) getSlots(endpoint string) chan struct{} {
+	limiter.lock.Lock()
+	defer limiter.lock.Unlock()
+	var slots, found = limiter.slots[endpoint]
+	if !found {
+		var limit, configured = appConfig.EndpointLimits[endpoint]
+		if !configured {
+			limit = appConfig.EndpointConcurrency
+		}
+		if !configured && endpoint == BACKEND_POOL {
+			limit = backends.capacity()
+		}
+		slots = make(chan struct{}, limit)
+		limiter.slots[endpoint] = slots
+	}
+	return slots
+}
+
+type endpointSlot struct {
+	slots chan struct{}
+	held  bool
+}
+
+type endpointSlotKey struct{}
+
+func (slot *endpointSlot) reacquire(ctx context.Context) error {
+	if slot == nil || slot.held {
+		return nil
+	}
+	select {
+	case slot.slots <- struct{}{}:
+		slot.held = true
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (slot *endpointSlot) release() {
+	if slot == nil || !slot.held {
+		return
+	}
+	<-slot.slots
+	slot.held = false
+}
+
+func withEndpointSlot(ctx context.Context, slot *endpointSlot) context.Context {
+	return context.WithValue(ctx, endpointSlotKey{}, slot)
+}
+
+func getEndpointSlot(ctx context.Context) *endpointSlot {
+	var slot, _ = ctx.Value(endpointSlotKey{}).(*endpointSlot)
+	return slot
+}
+
+func (limiter *endpointLimiter) acquire(ctx context.Context, endpoint string) (*endpointSlot, error) {
+	var slot = &endpointSlot{
+		slots: limiter.getSlots(endpoint),
+	}
+	var acquireError = slot.reacquire(ctx)
+	if acquireError != nil {
+		return nil, acquireError
+	}
+	return slot, nil
+}
+
+func startWorkers(count int) {
+	for i := 0; i < count; i++ {
+		go doProcessing()
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func newTestLimiter(t *testing.T, concurrency int, limits map[string]int) *endpointLimiter {
+	var saved = appConfig
+	t.Cleanup(func() {
+		appConfig = saved
+	})
+	appConfig.EndpointConcurrency = concurrency
+	appConfig.EndpointLimits = limits
+	return &endpointLimiter{
+		slots: map[string]chan struct{}{},
+	}
+}
+
+func TestEndpointLimiterAppliesLimits(t *testing.T) {
+	var limiter = newTestLimiter(t, 1, map[string]int{"http://wide": 3})
+	for endpoint, limit := range map[string]int{"http://narrow": 1, "http://wide": 3} {
+		var held = []*endpointSlot{}
+		for i := 0; i < limit; i++ {
+			var slot, err = limiter.acquire(context.Background(), endpoint)
+			if err != nil {
+				t.Fatalf("%s: slot %d: %v", endpoint, i, err)
+			}
+			held = append(held, slot)
+		}
+		var ctx, cancel = context.WithTimeout(context.Background(), 20*time.Millisecond)
+		if _, err := limiter.acquire(ctx, endpoint); !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("%s: expected no more than %d slots, got %v", endpoint, limit, err)
+		}
+		cancel()
+		for _, slot := range held {
+			slot.release()
+		}
+	}
+}
+
+func TestEndpointSlotsAreHandedOverOnRelease(t *testing.T) {
+	var limiter = newTestLimiter(t, 1, map[string]int{})
+	var first, _ = limiter.acquire(context.Background(), "http://a")
+	var acquired = make(chan *endpointSlot)
+	go func() {
+		var second, _ = limiter.acquire(context.Background(), "http://a")
+		acquired <- second
+	}()
+	select {
+	case <-acquired:
+		t.Fatal("the second request must wait for the first slot")
+	case <-time.After(20 * time.Millisecond):
+	}
+	first.release()
+	first.release()
+	var second = <-acquired
+	if len(limiter.getSlots("http://a")) != 1 {
+		t.Fatal("a double release must not free a slot it no longer holds")
+	}
+	second.release()
+	if err := second.reacquire(context.Background()); err != nil || !second.held {
+		t.Fatalf("expected a released slot to be reacquired, got %v", err)
+	}
+	second.release()
+}
+
+func TestEndpointSlotTravelsWithTheContext(t *testing.T) {
+	var limiter = newTestLimiter(t, 1, map[string]int{})
+	if getEndpointSlot(context.Background()) != nil {
+		t.Fatal("expected no slot on a bare context")
+	}
+	var nilSlot *endpointSlot
+	nilSlot.release()
+	if err := nilSlot.reacquire(context.Background()); err != nil {
+		t.Fatal("a missing slot must be a no-op")
+	}
+	var slot, _ = limiter.acquire(context.Background(), "http://a")
+	if getEndpointSlot(withEndpointSlot(context.Background(), slot)) != slot {
+		t.Fatal("expected the slot to be carried by the context")
+	}
+	slot.release()
+}
+
+func TestBackendPoolSlotsFollowPoolCapacity(t *testing.T) {
+	var limiter = newTestLimiter(t, 1, map[string]int{})
+	var savedBackends = backends
+	t.Cleanup(func() {
+		backends = savedBackends
+	})
+	backends = newBackendPool(map[string]int{"http://a": 1, "http://b": 1})
+	if cap(limiter.getSlots(BACKEND_POOL)) != backends.capacity() || backends.capacity() < 2 {
+		t.Fatalf("expected the pool to get %d slots, got %d", backends.capacity(), cap(limiter.getSlots(BACKEND_POOL)))
+	}
+}